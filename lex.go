@@ -1,10 +1,22 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf16"
 	"unicode/utf8"
+	"unsafe"
 )
 
 /*
@@ -16,21 +28,313 @@ Example:	http://golang.org/src/pkg/text/template/parse/lex.go
 
 // item thrown over the fence
 type item struct {
-	typ itemType
-	val string
+	typ  itemType
+	val  string
+	raw  string // source text, when it differs from val (escapes, normalizing)
+	pos  int    // start offset in input (bytes, or runes with runePositions)
+	line int    // 1-based line of pos
+	col  int    // 1-based column of pos, tabs advancing to the next tabWidth stop
+	doc  int    // document index (LexDocuments)
+
+	blockDepth int // blocks the item is inside, 0 for text and delimiters
+
+	endPos, endLine, endCol int // just past the item's source, see Span
+	srcStart, srcEnd        int // byte range in input, see SourceRange
+
+	input string // the whole input when val is left for Value to slice (offsetValues)
+
+	overflow  bool // number doesn't fit in an int64 (checkOverflow)
+	trimLeft  bool // text follows a " -}}" trim marker (trimMarkers)
+	trimRight bool // text precedes a "{{- " trim marker (trimMarkers)
+
+	leadingTrivia []string // skipped whitespace and comments before the item (attachTrivia)
+	afterError    bool     // EOF that follows an error rather than the end of input
+	synthetic     bool     // queued by Inject, not lexed
+	precedence    int      // operator binding strength, see DefaultPrecedence
 }
 
 type itemType int
 
+// kinds are grouped between unexported bounds, see the Is* predicates
 const (
 	itemError itemType = iota
 	itemEOF
+	itemText
+	itemNewline // '\n' in text (emitNewlines)
+	itemSpace   // whitespace in a block (keepWhitespace)
+	itemComment
+	itemBlockStart // structural, empty value
+	itemBlockEnd   // structural, empty value
+	itemIdentifier
+	itemKeyword      // identifier listed in keywords
+	itemEnvRef       // variable name, the whole block in envRefs mode
+	itemOpenSection  // '#' opening a block (sections)
+	itemCloseSection // '/' opening a block (sections)
+	itemHeredocTag   // "<<END" filling a block, value the terminator END
+	itemIllegal      // unexpected input skipped in recoverErrors mode
+
+	delimiterBeg
 	itemLeftMeta
 	itemRightMeta
+	itemLeftStmt  // "{%" (AddDelimiters)
+	itemRightStmt // "%}" (AddDelimiters)
+	delimiterEnd
+
+	literalBeg
 	itemNumber
-	itemText
+	itemString    // quoted string, value unescaped
+	itemDateTime  // 2006-01-02, 15:04, 15:04:05 or 2006-01-02T15:04[:05]
+	itemRawString // backquoted string, value without the quotes
+	itemRegex     // /pattern/flags
+	itemFloat     // special float value: inf, +inf, -inf or nan
+	itemHeredoc   // lines following a "{{<<END}}" block, up to END
+	itemPath      // "/users/{id}", up to whitespace (paths)
+	literalEnd
+
+	operatorBeg
+	itemOperator
+	operatorEnd
+
+	// punctuation inside blocks
+	itemLeftBrace  // '{'
+	itemRightBrace // '}'
+	itemColon
+	itemComma
+	itemLeftParen
+	itemRightParen
+	itemSemicolon // statement separator
+	itemQuestion  // ternary '?', paired with itemColon
+	itemAssign    // '='
+	itemDeclare   // ":="
+	itemAt        // '@' before a decorator name
+
+	numItemTypes // not a kind, sizes per-kind tables (Count)
 )
 
+var itemNames = map[itemType]string{
+	itemError:        "ERROR",
+	itemEOF:          "EOF",
+	itemLeftMeta:     "LEFTMETA",
+	itemRightMeta:    "RIGHTMETA",
+	itemLeftStmt:     "LEFTSTMT",
+	itemRightStmt:    "RIGHTSTMT",
+	itemNumber:       "NUMBER",
+	itemText:         "TEXT",
+	itemNewline:      "NEWLINE",
+	itemSpace:        "SPACE",
+	itemOperator:     "OPERATOR",
+	itemComment:      "COMMENT",
+	itemBlockStart:   "BLOCKSTART",
+	itemBlockEnd:     "BLOCKEND",
+	itemIdentifier:   "IDENTIFIER",
+	itemKeyword:      "KEYWORD",
+	itemEnvRef:       "ENVREF",
+	itemOpenSection:  "OPENSECTION",
+	itemCloseSection: "CLOSESECTION",
+	itemHeredocTag:   "HEREDOCTAG",
+	itemIllegal:      "ILLEGAL",
+	itemLeftBrace:    "LEFTBRACE",
+	itemRightBrace:   "RIGHTBRACE",
+	itemColon:        "COLON",
+	itemString:       "STRING",
+	itemDateTime:     "DATETIME",
+	itemRawString:    "RAWSTRING",
+	itemRegex:        "REGEX",
+	itemFloat:        "FLOAT",
+	itemHeredoc:      "HEREDOC",
+	itemPath:         "PATH",
+	itemComma:        "COMMA",
+	itemLeftParen:    "LEFTPAREN",
+	itemRightParen:   "RIGHTPAREN",
+	itemSemicolon:    "SEMICOLON",
+	itemQuestion:     "QUESTION",
+	itemAssign:       "ASSIGN",
+	itemDeclare:      "DECLARE",
+	itemAt:           "AT",
+}
+
+func (t itemType) String() string {
+	if name, ok := itemNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("item(%d)", int(t))
+}
+
+// IsDelimiter reports whether t is a block delimiter (meta)
+func (t itemType) IsDelimiter() bool {
+	return delimiterBeg < t && t < delimiterEnd
+}
+
+// IsLiteral reports whether t is a literal value
+func (t itemType) IsLiteral() bool {
+	return literalBeg < t && t < literalEnd
+}
+
+// IsOperator reports whether t is an operator
+func (t itemType) IsOperator() bool {
+	return operatorBeg < t && t < operatorEnd
+}
+
+// Equal compares kind and value only, ignoring position and annotations
+func (i item) Equal(other item) bool {
+	return i.typ == other.typ && i.Value() == other.Value()
+}
+
+// Value is the item's value. With offsetValues an item whose value is its
+// source text carries only the offsets, and Value slices it from the input
+// on each call instead of the lexer storing a string per item.
+func (i item) Value() string {
+	if i.input != "" {
+		return i.input[i.srcStart:i.srcEnd]
+	}
+	return i.val
+}
+
+// EqualExact compares every field
+func (i item) EqualExact(other item) bool {
+	return reflect.DeepEqual(i, other)
+}
+
+// MarshalJSON encodes the kind by name along with the value and position
+func (i item) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		Val  string `json:"val"`
+		Pos  int    `json:"pos"`
+		Line int    `json:"line"`
+		Col  int    `json:"col"`
+	}{i.typ.String(), i.Value(), i.pos, i.line, i.col})
+}
+
+// ByteLen is the length of the value in bytes
+func (i item) ByteLen() int {
+	return len(i.Value())
+}
+
+// RuneLen is the length of the value in runes
+func (i item) RuneLen() int {
+	return utf8.RuneCountInString(i.Value())
+}
+
+// SourceRange is the byte range of input the item was lexed from, whether or
+// not positions count runes, so input[start:end] is Raw(). Items not lexed
+// from a range of input (errors, injected items) return 0, 0.
+func (i item) SourceRange() (start, end int) {
+	return i.srcStart, i.srcEnd
+}
+
+// Span is the source range of an item, the end just past its last rune
+type Span struct {
+	StartPos, EndPos   int
+	StartLine, EndLine int
+	StartCol, EndCol   int
+}
+
+// Span is where the item was lexed from. Errors and the EOF after one have
+// no extent and end where they start.
+func (i item) Span() Span {
+	s := Span{i.pos, i.endPos, i.line, i.endLine, i.col, i.endCol}
+	if i.endLine == 0 {
+		s.EndPos, s.EndLine, s.EndCol = i.pos, i.line, i.col
+	}
+	return s
+}
+
+// CompareItems checks got against want by kind and value, describing the
+// first difference, for tests of lexers and their options
+func CompareItems(got, want []item) error {
+	for n := range min(len(got), len(want)) {
+		if !got[n].Equal(want[n]) {
+			return fmt.Errorf("item %d: got %s %q, want %s %q", n, got[n].typ, got[n].Value(), want[n].typ, want[n].Value())
+		}
+	}
+	switch {
+	case len(got) > len(want):
+		return fmt.Errorf("item %d: got %s %q, want no more items", len(want), got[len(want)].typ, got[len(want)].Value())
+	case len(got) < len(want):
+		return fmt.Errorf("item %d: got no more items, want %s %q", len(got), want[len(got)].typ, want[len(got)].Value())
+	}
+	return nil
+}
+
+// HighlightSpan is a Span of input labeled for syntax highlighting
+type HighlightSpan struct {
+	Span
+	Category string // "text", "delimiter", "number", ..., "whitespace" for skipped input
+}
+
+// HighlightSpans lexes input in recoverErrors mode and labels every byte of
+// it: the spans are in order, never overlap and leave no gaps. Input past a
+// lex error is a single "error" span.
+func HighlightSpans(name, input string) []HighlightSpan {
+	l := NewSyncScanner(name, input)
+	l.recoverErrors = true
+	var spans []HighlightSpan
+	at := Span{EndLine: 1, EndCol: 1} // end of what's covered
+	add := func(s Span, cat string) {
+		if s.StartPos > at.EndPos {
+			gap := Span{at.EndPos, s.StartPos, at.EndLine, s.StartLine, at.EndCol, s.StartCol}
+			spans = append(spans, HighlightSpan{gap, "whitespace"})
+		}
+		spans = append(spans, HighlightSpan{s, cat})
+		at = s
+	}
+	tail := "whitespace" // skipped input right before EOF
+	for i := l.nextItem(); i.typ != itemEOF; i = l.nextItem() {
+		if i.typ == itemError {
+			tail = "error"
+			break
+		}
+		if s := i.Span(); s.EndPos > s.StartPos {
+			add(s, highlightCategory(i.typ))
+		}
+	}
+	if at.EndPos < len(input) {
+		// the rest wasn't lexed, so walk it for the end position
+		end := NewSyncScanner(name, input)
+		end.advance(len(input))
+		add(Span{at.EndPos, len(input), at.EndLine, end.line, at.EndCol, end.col}, tail)
+	}
+	return spans
+}
+
+// highlightCategory labels an item kind for HighlightSpans
+func highlightCategory(t itemType) string {
+	switch {
+	case t == itemText || t == itemNewline || t == itemHeredoc:
+		return "text"
+	case t.IsDelimiter() || t == itemOpenSection || t == itemCloseSection:
+		return "delimiter"
+	case t == itemNumber || t == itemFloat:
+		return "number"
+	case t == itemString || t == itemRawString || t == itemPath:
+		return "string"
+	case t.IsLiteral():
+		return "literal"
+	case t.IsOperator():
+		return "operator"
+	case t == itemKeyword || t == itemHeredocTag:
+		return "keyword"
+	case t == itemIdentifier || t == itemEnvRef:
+		return "identifier"
+	case t == itemComment:
+		return "comment"
+	case t == itemSpace:
+		return "whitespace"
+	case t == itemIllegal:
+		return "error"
+	}
+	return "punctuation"
+}
+
+// Raw is the source text the item was lexed from
+func (i item) Raw() string {
+	if i.raw != "" {
+		return i.raw
+	}
+	return i.Value()
+}
+
 func (i item) String() string {
 	switch i.typ {
 	case itemEOF:
@@ -39,10 +343,10 @@ func (i item) String() string {
 		return i.val
 	}
 	// truncating
-	if len(i.val) > 10 {
-		return fmt.Sprintf("%.10q...", i.val) // safety escaped
+	if v := i.Value(); len(v) > 10 {
+		return fmt.Sprintf("%.10q...", v) // safety escaped
 	}
-	return fmt.Sprintf("%q", i.val)
+	return fmt.Sprintf("%q", i.Value())
 }
 
 // state function returns next state (function)
@@ -56,41 +360,318 @@ type lexer struct {
 	pos   int       // current position in input
 	width int       // last rune size
 	items chan item // items over the fence
+	prev  itemType  // last emitted item type
+
+	runeStart  int      // rune count at start
+	runePos    int      // rune count at pos
+	blockStart int      // pos just past the current block's left delimiter
+	trimNext   bool     // last right meta had a trim marker
+	trivia     []string // pending leading trivia (attachTrivia)
+	depth      int      // bracket nesting inside the current block
+	blockDepth int      // blocks open around pos, not counting their delimiters
+	blocks     int      // blocks started so far
+	heredoc    string   // terminator of the heredoc whose marker block is closing
+	line, col  int      // location of pos
+	startLine  int      // location of start
+	startCol   int
+	prevLine   int // location before the last next, for backup
+	prevCol    int
+
+	done     chan struct{} // closed by Close (goroutine mode only)
+	started  bool          // run goroutine launched
+	sync     bool          // queue items in pending instead of the channel
+	pending  []item        // queued items (sync mode, or inline past the buffer)
+	head     int           // next unread index into pending
+	recorded []item        // delivered items (recordItems only)
+	errored  bool          // terminated by errorf
+	errs     []item        // delivered error and illegal items
+	consumed atomic.Int64  // pos, for Progress to read while run moves it
+	size     atomic.Int64  // len(input), likewise as onEOF grows it
+
+	diagnostics []Diagnostic // warnings and errors, in the order found
+
+	// options
+	leftDelim            string // opens a block (DefaultLeftDelim)
+	rightDelim           string // closes a block (DefaultRightDelim)
+	envRefs              bool   // a block holds a single name, lexed as itemEnvRef ("${HOME}")
+	numbersOnly          bool   // blocks hold only numbers and whitespace (NewNumberScanner)
+	maxItems             int    // stop collecting after this many items (0 = unlimited)
+	allowMultilineBlocks bool   // newlines inside blocks are whitespace
+	lineCommentMarker    string // starts a comment running to end of line in multiline blocks ("" = off)
+	unicodeWhitespace    bool   // any unicode.IsSpace rune is whitespace inside blocks
+	blockMarkers         bool   // bracket block contents with itemBlockStart/itemBlockEnd
+	errorSnippet         bool   // append the input around the error position to error items
+	runePositions        bool   // item positions count runes instead of bytes
+	checkOverflow        bool   // flag numbers that overflow int64
+	ignoreRunes          string // runes skipped like whitespace inside blocks, ahead of any token meaning
+	disableNumbers       bool   // no number literals: digits start identifiers like letters do
+	dateTimes            bool   // lex date/time literals instead of numbers and operators
+	recordItems          bool   // keep every delivered item for Recorded (memory grows with the stream)
+	normalizeNumbers     bool   // number values lose '+' and leading zeros, hex prefix lowercased (source in raw)
+	maxBlockLen          int    // error once a block's contents pass this many bytes (0 = unlimited)
+	trimMarkers          bool   // recognise "{{- " and " -}}", flagging the adjacent text
+	delimEscape          string // in text, escapes a left delimiter into literal text ("" = off)
+	recoverErrors        bool   // unexpected block runes become itemIllegal instead of ending the run
+	tabWidth             int    // column width of tab stops (0 or 1 = a tab is one column)
+	offsetValues         bool   // values that are the source text stay offsets into input, see Value
+	attachTrivia         bool   // block whitespace and comments go on the next item instead of being dropped/emitted
+	numberUnderscores    bool   // allow '_' between digits (1_000, 0x_FF), dropped from the value
+	maxNestDepth         int    // error on brackets nested deeper than this (0 = unlimited)
+	signsAreOperators    bool   // '+' and '-' are always operators, never part of a number
+	normalizeIdentifiers bool   // identifier values are lowercased (source in raw)
+	foldKeywords         bool   // keywords match case-insensitively, against the lowercased identifier
+	specialFloats        bool   // inf, -inf and nan are itemFloat, case-insensitively with foldKeywords
+	stopAfterFirstBlock  bool   // input after the first block is one text item, not scanned for blocks
+	sections             bool   // a '#' or '/' opening a block is itemOpenSection or itemCloseSection
+	paths                bool   // a '/' where a regex could start begins an itemPath instead ("/users/1")
+	strictNumberBoundary bool   // a letter right after a number is an error, not the start of an identifier
+	noTabsInBlocks       bool   // a tab inside a block is an error rather than whitespace
+	emitNewlines         bool   // newlines in text are itemNewline, splitting the text around them
+	keepWhitespace       bool   // whitespace runs inside blocks are itemSpace instead of being ignored
+	trimTokenValues      bool   // block item values lose surrounding whitespace (e.g. from registered sub-lexers)
+	doubledDelimEscape   bool   // in text, "{{{{" is a literal "{{"
+	maxBlocks            int    // error on the block after this many (0 = unlimited)
+
+	keywords  map[string]bool            // identifiers lexed as itemKeyword
+	operators []string                   // operators beyond "+-*/%" and "==", matched longest first ("**", "<=")
+	phrases   []string                   // multi-word keywords ("not in"), words separated by whitespace
+	precTable map[string]int             // operator precedence (nil = DefaultPrecedence)
+	runeClass func(r rune) tokenCategory // classifies block runes (nil = defaultClass)
+	subLexers []subLexer                 // built-in then registered sub-lexers
+
+	identStart func(r rune) bool // starts an identifier (nil = letter class runes)
+	identCont  func(r rune) bool // continues one (nil = letter and digit class runes)
+
+	onTransition func(from, to string) // OnTransition hook
+	onEOF        func() string         // more input when text reaches the end ("" = stop)
+
+	peek   item // read ahead by Peek
+	peeked bool // peek holds the next item
+
+	injected []item // Inject queue, read before anything else
+
+	block  delimPair   // delimiters of the block being lexed
+	delims []delimPair // AddDelimiters pairs, after leftDelim/rightDelim
+
+	counts [numItemTypes]atomic.Int64 // items emitted per type, see Count
+
+	src []byte // the bytes input shares its memory with (NewScannerBytes)
+}
+
+// send puts an item on the channel, giving up once the client has closed us
+func (l *lexer) send(i item) {
+	if 0 <= i.typ && i.typ < numItemTypes {
+		l.counts[i.typ].Add(1)
+	}
+	if l.sync {
+		l.pending = append(l.pending, i)
+		return
+	}
+	if l.done == nil {
+		// inline: nothing reads while a state runs, so what the buffer
+		// can't take waits in pending, behind everything buffered
+		if l.head < len(l.pending) {
+			l.pending = append(l.pending, i)
+			return
+		}
+		select {
+		case l.items <- i:
+		default:
+			l.pending = append(l.pending, i)
+		}
+		return
+	}
+	select {
+	case l.items <- i:
+	case <-l.done:
+	}
 }
 
-// emit throws items over the fence (to client)
+// emit throws items over the fence (to client), valued as the source text
 func (l *lexer) emit(t itemType) {
-	l.items <- item{t, l.input[l.start:l.pos]}
-	l.start = l.pos
+	l.emitValue(t, l.input[l.start:l.pos])
+}
+
+// emitValue is emit with a value other than the source text (e.g. unescaped)
+func (l *lexer) emitValue(t itemType, val string) {
+	l.emitItem(l.thisItem(t, val))
+}
+
+// thisItem builds the item spanning start..pos, for callers that need to
+// annotate it before emitItem
+func (l *lexer) thisItem(t itemType, val string) item {
+	i := item{typ: t, val: val, pos: l.startPos(), line: l.startLine, col: l.startCol}
+	i.endPos, i.endLine, i.endCol = l.curPos(), l.line, l.col
+	i.srcStart, i.srcEnd = l.start, l.pos
+	i.blockDepth = l.blockDepth
+	if src := l.input[l.start:l.pos]; src != val {
+		i.raw = src
+	}
+	return i
+}
+
+func (l *lexer) emitItem(i item) {
+	if l.trimTokenValues && l.blockDepth > 0 && trimmable(i.typ) {
+		i.val = strings.TrimSpace(i.val)
+	}
+	if i.typ == itemOperator {
+		i.precedence = l.precedenceOf(i.val)
+	}
+	if l.attachTrivia {
+		if i.typ == itemComment {
+			l.trivia = append(l.trivia, i.val)
+			l.markStart()
+			return
+		}
+		i.leadingTrivia, l.trivia = l.trivia, nil
+	}
+	if l.offsetValues && i.raw == "" && i.val == l.input[i.srcStart:i.srcEnd] {
+		// still the source text, not unescaped, normalized or trimmed
+		i.val, i.input = "", l.input
+	}
+	l.send(i)
+	l.markStart()
+	if i.typ != itemComment && i.typ != itemSpace {
+		// neither changes what a '-' or '/' after it means
+		l.prev = i.typ
+	}
+}
+
+// trimmable reports whether trimTokenValues applies to t: not to itemSpace
+// itself, nor to literals and comments whose whitespace is content
+func trimmable(t itemType) bool {
+	switch t {
+	case itemSpace, itemComment, itemString, itemRawString, itemRegex:
+		return false
+	}
+	return true
+}
+
+// DefaultPrecedence ranks binary operators, higher binding tighter. Only
+// the single runes "+-*/%" and "==" lex as operators by default; the others
+// need listing in operators.
+var DefaultPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "//": 5, "%": 5,
+	"**": 6,
+}
+
+// precedenceOf looks op up in the precedence table, 0 when it isn't listed
+func (l *lexer) precedenceOf(op string) int {
+	if l.precTable != nil {
+		return l.precTable[op]
+	}
+	return DefaultPrecedence[op]
 }
 
+// built-in defaults
 const (
-	leftMeta  = "{{"
-	rightMeta = "}}"
+	DefaultLeftDelim  = "{{"
+	DefaultRightDelim = "}}"
+	DefaultBufferSize = 2 // items buffered between the state machine and the client
 )
 
+// startPos is the reported position of the current item
+func (l *lexer) startPos() int {
+	if l.runePositions {
+		return l.runeStart
+	}
+	return l.start
+}
+
+// curPos is pos as reported in items
+func (l *lexer) curPos() int {
+	if l.runePositions {
+		return l.runePos
+	}
+	return l.pos
+}
+
 const eof = -1
 
 // states:
 // plaintext
 func lexText(l *lexer) stateFn {
+	// unescaped value, only built once an escape turns up
+	var b strings.Builder
+	seg := l.start // start of source not yet copied into b
+	text := func() string {
+		if b.Len() == 0 {
+			return l.input[l.start:l.pos]
+		}
+		return b.String() + l.input[seg:l.pos]
+	}
+	doubled := l.leftDelim + l.leftDelim
 	// scan until {{ is found
 	for {
-		if strings.HasPrefix(l.input[l.pos:], leftMeta) {
-			// check if we have un-emitted (buffer) plaintext
+		n, lit := 0, l.leftDelim
+		switch rest := l.input[l.pos:]; {
+		case l.delimEscape != "" && strings.HasPrefix(rest, l.delimEscape):
+			// escapes before a delimiter pair up into literal ones, an odd
+			// one out escaping the delimiter: `\\{{` is `\` then a block
+			k := 1
+			for strings.HasPrefix(rest[k*len(l.delimEscape):], l.delimEscape) {
+				k++
+			}
+			if !strings.HasPrefix(rest[k*len(l.delimEscape):], l.leftDelim) {
+				l.advance(k * len(l.delimEscape)) // plain text
+				continue
+			}
+			n, lit = k*len(l.delimEscape), strings.Repeat(l.delimEscape, k/2)
+			if k%2 == 1 {
+				n, lit = n+len(l.leftDelim), lit+l.leftDelim
+			}
+		case l.doubledDelimEscape && strings.HasPrefix(rest, doubled):
+			n = len(doubled)
+		}
+		if n > 0 {
+			// literal "{{" and escapes, keep scanning text
+			b.WriteString(l.input[seg:l.pos])
+			b.WriteString(lit)
+			l.advance(n)
+			seg = l.pos
+			continue
+		}
+		if p, ok := l.delimAt(); ok {
+			l.block = p
+			// check if we have un-emitted (buffer) plaintext; emitting the
+			// right meta reset start, so "}}{{" brings no empty text
 			if l.pos > l.start {
-				l.emit(itemText)
+				l.emitText(text())
 			}
 			// change state to left meta
 			return lexLeftMeta
 		}
+		if l.emitNewlines && strings.HasPrefix(l.input[l.pos:], "\n") {
+			if l.pos > l.start {
+				l.emitText(text())
+			}
+			b.Reset()
+			l.trimNext = false
+			l.next()
+			l.emit(itemNewline)
+			seg = l.pos
+			continue
+		}
 		if l.next() == eof {
+			if more := l.more(); more != "" {
+				l.input += more
+				l.size.Store(int64(len(l.input)))
+				l.src = nil // a copy now, no longer the caller's bytes
+				continue
+			}
 			break
 		}
+		// nothing can match before the next byte a delimiter or escape
+		// starts with, and that byte is never inside a multi-byte rune
+		l.advance(l.untilDelim())
 	}
 	// eof, check if we have buffered plaintext
 	if l.pos > l.start {
-		l.emit(itemText)
+		l.emitText(text())
 	}
 	// let the client know we're done
 	l.emit(itemEOF)
@@ -98,143 +679,1769 @@ func lexText(l *lexer) stateFn {
 	return nil
 }
 
-// metas
-func lexLeftMeta(l *lexer) stateFn {
-	l.pos += len(leftMeta)
-	l.emit(itemLeftMeta)
-	// change state to insideBlock
-	return lexInsideBlock
+// delimPair is a left and right delimiter and the metas they lex as
+type delimPair struct {
+	left, right         string
+	leftType, rightType itemType
 }
 
-func lexRightMeta(l *lexer) stateFn {
-	l.pos += len(rightMeta)
-	l.emit(itemRightMeta)
-	return lexText
+// AddDelimiters lets blocks also open with left and close with right,
+// emitting leftType and rightType as their metas (e.g. "{%", "%}",
+// itemLeftStmt, itemRightStmt). Pairs are tried after leftDelim/rightDelim,
+// in the order added.
+func (l *lexer) AddDelimiters(left, right string, leftType, rightType itemType) {
+	l.delims = append(l.delims, delimPair{left, right, leftType, rightType})
 }
 
-// block
-func lexInsideBlock(l *lexer) stateFn {
-	// scan until }} is found
-	for {
-		if strings.HasPrefix(l.input[l.pos:], rightMeta) {
-			// QUESTION: why not checking buffering?
-			return lexRightMeta
-		}
-		switch r := l.next(); {
-		case r == eof || r == '\n':
-			return l.errorf("unclosed block")
-		case r == ' ' || r == '\t':
-			l.ignore()
-		case r == '+' || r == '-' || r >= '0' && r <= '9':
-			l.backup()
-			return lexNumber
-		default:
-			return l.errorf("unexpected char in block: %#U", r)
+// untilDelim is how many bytes from pos lie before anything lexText has to
+// look at: the first byte of a left delimiter, of delimEscape or, with
+// emitNewlines, a newline
+func (l *lexer) untilDelim() int {
+	rest := l.input[l.pos:]
+	n := len(rest)
+	find := func(s string) {
+		if s != "" {
+			if i := strings.IndexByte(rest[:n], s[0]); i >= 0 {
+				n = i
+			}
 		}
 	}
+	find(l.leftDelim)
+	find(l.delimEscape)
+	if l.emitNewlines {
+		find("\n")
+	}
+	for _, p := range l.delims {
+		find(p.left)
+	}
+	return n
 }
 
-// numbers
-const digits = "0123456789"
+// delimAt finds the delimiter pair whose left delimiter starts at pos
+func (l *lexer) delimAt() (delimPair, bool) {
+	rest := l.input[l.pos:]
+	if strings.HasPrefix(rest, l.leftDelim) {
+		return delimPair{l.leftDelim, l.rightDelim, itemLeftMeta, itemRightMeta}, true
+	}
+	for _, p := range l.delims {
+		if strings.HasPrefix(rest, p.left) {
+			return p, true
+		}
+	}
+	return delimPair{}, false
+}
 
-func lexNumber(l *lexer) stateFn {
-	l.accept("+-")
-	l.acceptRun(digits)
-	l.emit(itemNumber)
-	return lexInsideBlock
+// more asks onEOF for input to carry on with
+func (l *lexer) more() string {
+	if l.onEOF == nil {
+		return ""
+	}
+	return l.onEOF()
 }
 
-// helpers
-func (l *lexer) ignore() {
-	l.start = l.pos
+// emitText emits plaintext flagged with any trim markers around it
+func (l *lexer) emitText(val string) {
+	i := l.thisItem(itemText, val)
+	i.trimLeft = l.trimNext
+	i.trimRight = l.atLeftTrim()
+	l.emitItem(i)
 }
 
-func (l *lexer) backup() {
-	l.pos -= l.width
+// trim markers, a '-' separated by whitespace from the block contents
+const trimMarker = "-"
+
+// atLeftTrim reports whether input continues with "{{- "
+func (l *lexer) atLeftTrim() bool {
+	if !l.trimMarkers || !strings.HasPrefix(l.input[l.pos:], l.block.left+trimMarker) {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(l.input[l.pos+len(l.block.left)+len(trimMarker):])
+	return r == ' ' || r == '\t' || r == '\n'
 }
 
-// get next rune, but rewind (backup)
-func (l *lexer) peak() rune {
-	r := l.next()
-	l.backup()
-	return r
+// atRightTrim reports whether input continues with "-}}" after whitespace
+func (l *lexer) atRightTrim() bool {
+	if !l.trimMarkers || !strings.HasPrefix(l.input[l.pos:], trimMarker+l.block.right) || l.pos == 0 {
+		return false
+	}
+	r, _ := utf8.DecodeLastRuneInString(l.input[:l.pos])
+	return r == ' ' || r == '\t' || r == '\n'
 }
 
-// check if next rune is in valid range
-func (l *lexer) accept(valid string) bool {
-	if strings.IndexRune(valid, l.next()) >= 0 {
-		return true
+// metas, valued with the delimiter text matched (trim marker included)
+func lexLeftMeta(l *lexer) stateFn {
+	if l.blocks++; l.maxBlocks > 0 && l.blocks > l.maxBlocks {
+		return l.errorf("more than %d blocks", l.maxBlocks)
 	}
-	// otherwise rewind and deny
-	l.backup()
-	return false
+	l.trimNext = false
+	if l.atLeftTrim() {
+		l.advance(len(l.block.left) + len(trimMarker))
+	} else {
+		l.advance(len(l.block.left))
+	}
+	l.emit(l.block.leftType)
+	l.blockStart = l.pos
+	l.depth = 0
+	l.blockDepth = 1
+	if l.blockMarkers {
+		l.emit(itemBlockStart)
+	}
+	if l.envRefs {
+		return lexEnvRef
+	}
+	if l.numbersOnly {
+		return lexNumbers
+	}
+	if strings.HasPrefix(l.input[l.pos:], "<<") {
+		return lexHeredoc
+	}
+	if strings.HasPrefix(l.input[l.pos:], "/*") {
+		return lexComment
+	}
+	if l.sections && strings.ContainsRune("#/", l.peak()) {
+		return lexSection
+	}
+	// change state to insideBlock
+	return lexInsideBlock
 }
 
-// read until no longer valid
-func (l *lexer) acceptRun(valid string) {
-	for strings.IndexRune(valid, l.next()) >= 0 {
+// section marker right after the left delimiter, "{{#each}}" or "{{/each}}"
+func lexSection(l *lexer) stateFn {
+	if l.next() == '#' {
+		l.emit(itemOpenSection)
+	} else {
+		l.emit(itemCloseSection)
 	}
-	// unwanted rune reached, rewind
-	l.backup()
+	return lexInsideBlock
 }
 
-func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	// throw error over the fence
-	l.items <- item{
-		itemError,
-		fmt.Sprintf(format, args),
+// block of whitespace separated decimal numbers (NewNumberScanner), without
+// the general dispatch
+func lexNumbers(l *lexer) stateFn {
+	for {
+		if strings.HasPrefix(l.input[l.pos:], l.block.right) {
+			return lexRightMeta
+		}
+		r := l.next()
+		switch {
+		case l.isSpace(r):
+			l.ignore()
+		case isDigit(r) || (r == '+' || r == '-') && isDigit(l.peak()):
+			for isDigit(l.next()) {
+			}
+			l.backup()
+			l.emit(itemNumber)
+			return lexNumbers
+		case r == eof:
+			return l.errorf("unclosed block")
+		default:
+			return l.errorf("unexpected char in number block: %#U", r)
+		}
 	}
-	// abort state machine
-	return nil
 }
 
-// API for traversing and/or parsing
+// reference name filling the whole block, no whitespace around it
+func lexEnvRef(l *lexer) stateFn {
+	for c := l.classify(l.next()); c == catLetter || c == catDigit; c = l.classify(l.next()) {
+	}
+	l.backup()
+	if l.pos == l.start || !strings.HasPrefix(l.input[l.pos:], l.block.right) {
+		return l.errorf("malformed reference: %.20q", l.input[l.blockStart:])
+	}
+	l.emit(itemEnvRef)
+	return lexRightMeta
+}
 
-// return new scanner
-func NewScanner(name, input string) *lexer {
-	return &lexer{
-		name:  name,
-		input: input,
-		state: lexText,
-		items: make(chan item, 2), // might not be needed here, but no reason to let memory go above what's needed
+func lexRightMeta(l *lexer) stateFn {
+	// comments and ignored runes don't count as nothing, whitespace does
+	if (l.prev == l.block.leftType || l.prev == itemBlockStart) && strings.TrimSpace(l.input[l.blockStart:l.pos]) == "" {
+		l.warnf("empty block")
+	}
+	if l.blockMarkers {
+		l.emit(itemBlockEnd)
+	}
+	l.blockDepth = 0
+	if l.trimNext = l.atRightTrim(); l.trimNext {
+		l.advance(len(trimMarker))
+	}
+	l.advance(len(l.block.right))
+	l.emit(l.block.rightType)
+	if l.heredoc != "" {
+		return lexHeredocBody
+	}
+	if l.stopAfterFirstBlock {
+		return lexRest
 	}
+	return lexText
 }
-func (l *lexer) next() (r rune) {
-	// check if end has been reached
-	if l.pos >= len(l.input) {
-		l.width = 0 // QUESTION: to not break backup?
-		return eof
+
+// heredoc marker, "{{<<END}}", emitted as itemHeredocTag "END": the lines
+// after the block up to one that is exactly END are a single itemHeredoc
+func lexHeredoc(l *lexer) stateFn {
+	l.advance(len("<<"))
+	for c := l.classify(l.next()); c == catLetter || c == catDigit; c = l.classify(l.next()) {
 	}
-	// read next rune
-	r, l.width = utf8.DecodeRuneInString(l.input[l.pos:])
-	l.pos += l.width
-	return r
+	l.backup()
+	l.heredoc = l.input[l.start+len("<<") : l.pos]
+	if l.heredoc == "" || !strings.HasPrefix(l.input[l.pos:], l.block.right) {
+		return l.errorf("malformed heredoc marker")
+	}
+	// kept so a parser can tell the block from an empty one
+	l.emitValue(itemHeredocTag, l.heredoc)
+	return lexRightMeta
 }
 
-// state machine
-func (l *lexer) nextItem() item {
+// heredoc body, the value without the newlines around it
+func lexHeredocBody(l *lexer) stateFn {
+	end := l.heredoc
+	l.heredoc = ""
+	if l.next() != '\n' {
+		return l.errorf("heredoc %s must start on a new line", end)
+	}
+	l.skip()
 	for {
-		select {
-		case i := <-l.items:
-			return i
-		default:
-			l.state = l.state(l)
+		rest := l.input[l.pos:]
+		n := strings.IndexByte(rest, '\n')
+		if n < 0 {
+			n = len(rest)
+		}
+		if rest[:n] == end {
+			break
+		}
+		if n == len(rest) {
+			return l.errorf("unterminated heredoc %s", end)
 		}
+		l.advance(n + 1)
 	}
-	// we've escaped the state functions
-	panic("no state function, but still in state machine")
+	l.emitValue(itemHeredoc, strings.TrimSuffix(l.input[l.start:l.pos], "\n"))
+	// the terminating line, newline included
+	l.advance(len(end))
+	l.accept("\n")
+	l.skip()
+	return lexText
 }
 
-func main() {
-	flag.Parse()
-	input := flag.Arg(0)
-	fmt.Printf("lexing %.100q...\n", input)
-	s := NewScanner("number lexer", input)
+// everything left, as one text item
+func lexRest(l *lexer) stateFn {
+	l.advance(len(l.input) - l.pos)
+	if l.pos > l.start {
+		l.emitText(l.input[l.start:l.pos])
+	}
+	l.emit(itemEOF)
+	return nil
+}
+
+// block
+// every transition into here (lexLeftMeta, a sub-lexer, an operator or
+// punctuation) has just emitted, and whitespace is ignored as it's read, so
+// start == pos at the top of the loop and nothing is pending at "}}"
+func lexInsideBlock(l *lexer) stateFn {
+	// scan until }} is found
 	for {
-		if i := s.nextItem(); i.typ != itemEOF {
-			fmt.Println(i)
-		} else {
-			break
-		} 
+		if strings.HasPrefix(l.input[l.pos:], l.block.right) || l.atRightTrim() {
+			// a state that read without emitting broke the invariant above;
+			// whatever it read has no kind to emit as
+			if l.pos > l.start {
+				return l.errorf("internal error: %q left pending at right delimiter", l.input[l.start:l.pos])
+			}
+			return lexRightMeta
+		}
+		if l.blockTooLong() {
+			return l.errorf("block longer than %d bytes", l.maxBlockLen)
+		}
+		// a line comment runs past "}}" to the newline, so it only makes
+		// sense in blocks that span lines
+		if l.allowMultilineBlocks && l.lineCommentMarker != "" && strings.HasPrefix(l.input[l.pos:], l.lineCommentMarker) {
+			return lexLineComment
+		}
+		r := l.next()
+		sub := l.subLexerFor(r)
+		switch c := l.classify(r); {
+		case r == eof:
+			return l.errorf("unclosed block")
+		case r == '\n':
+			if !l.allowMultilineBlocks {
+				return l.errorf("unclosed block")
+			}
+			l.skip()
+		case r == '\t' && l.noTabsInBlocks:
+			return l.errorf("tab in block")
+		case strings.ContainsRune(l.ignoreRunes, r):
+			// takes precedence, so ignoreRunes "," drops commas instead of
+			// emitting itemComma
+			l.skip()
+		case sub != nil:
+			l.backup()
+			return sub
+		case c == catOperator && r == '/' && !l.prevIsValue():
+			// division only follows an operand, otherwise it's a regex, or
+			// a path when paths are on
+			if l.paths {
+				return lexPath
+			}
+			return lexRegex
+		case c == catOperator || l.operatorLen(l.input[l.pos-l.width:]) > 0:
+			l.backup()
+			return lexOperator
+		case c == catDigit && l.dateTimes && dateTimeLen(l.input[l.pos-l.width:]) > 0:
+			l.backup()
+			return lexDateTime
+		case c == catDigit || l.startsIdent(r):
+			l.backup()
+			return lexIdentifier
+		case r == '{':
+			// "{{" never nests, only a lone '{' is a brace
+			if strings.HasPrefix(l.input[l.pos-l.width:], l.block.left) {
+				return l.errorf("unexpected left delimiter in block")
+			}
+			return l.nest(itemLeftBrace, 1)
+		case r == '}':
+			// "}}" was checked above, so it's the right delimiter that wins
+			// in "1}}}" and the trailing '}' becomes text
+			return l.nest(itemRightBrace, -1)
+		case r == ':':
+			if l.peak() == '=' {
+				l.next()
+				l.emit(itemDeclare)
+				return lexInsideBlock
+			}
+			l.emit(itemColon)
+			return lexInsideBlock
+		case r == '=':
+			if l.peak() == '=' {
+				// comparison, not assignment
+				l.next()
+				l.emit(itemOperator)
+				return lexInsideBlock
+			}
+			// assignment, or an attribute as in {{ button class="x" }}
+			l.emit(itemAssign)
+			return lexInsideBlock
+		case r == '"':
+			return lexString
+		case r == '`':
+			return lexRawString
+		case r == ',':
+			l.emit(itemComma)
+			return lexInsideBlock
+		case r == '(':
+			return l.nest(itemLeftParen, 1)
+		case r == ')':
+			return l.nest(itemRightParen, -1)
+		case r == ';':
+			l.emit(itemSemicolon)
+			return lexInsideBlock
+		case r == '?':
+			l.emit(itemQuestion)
+			return lexInsideBlock
+		case r == '@':
+			// decorator, "@cache(10)"; a runeClass making '@' a letter
+			// gets there first and lexes "@cache" as one identifier
+			l.emit(itemAt)
+			return lexInsideBlock
+		default:
+			if l.recoverErrors {
+				l.emit(itemIllegal)
+				return lexInsideBlock
+			}
+			return l.errorf("unexpected char in block: %#U", r)
+		}
+	}
+}
+
+// subLexer takes over block contents starting with a rune it matches
+type subLexer struct {
+	match func(r rune) bool // called with pos just past r
+	state stateFn           // entered with pos back at r
+}
+
+// builtinSubLexers come ahead of any registered ones
+func (l *lexer) builtinSubLexers() []subLexer {
+	return []subLexer{
+		{l.atSpace, lexSpace},
+		{l.atNumber, lexNumber},
+		{l.atSpecialFloat, lexSpecialFloat},
+	}
+}
+
+// Register adds a sub-lexer for block contents, consulted in registration
+// order after the built-ins (whitespace, numbers) and before the rest of
+// the dispatch. state must emit or ignore what it reads and carry on with
+// lexInsideBlock.
+func (l *lexer) Register(match func(r rune) bool, state stateFn) {
+	l.subLexers = append(l.subLexers, subLexer{match, state})
+}
+
+func (l *lexer) subLexerFor(r rune) stateFn {
+	for _, sub := range l.subLexers {
+		if sub.match(r) {
+			return sub.state
+		}
+	}
+	return nil
+}
+
+func (l *lexer) atSpace(r rune) bool {
+	if r == '\t' && l.noTabsInBlocks {
+		return false
+	}
+	return r != '\n' && l.classify(r) == catWhitespace
+}
+
+// whitespace run, ignored
+func lexSpace(l *lexer) stateFn {
+	for l.atSpace(l.next()) {
+	}
+	l.backup()
+	if l.keepWhitespace {
+		l.emit(itemSpace)
+	} else {
+		l.skip()
+	}
+	return lexInsideBlock
+}
+
+// atNumber reports whether r starts a number literal
+func (l *lexer) atNumber(r rune) bool {
+	switch c := l.classify(r); {
+	case l.disableNumbers:
+		return false
+	case c == catOperator && (r == '+' || r == '-'):
+		if l.signsAreOperators {
+			return false
+		}
+		// a sign only belongs to a number when it can't be an operator,
+		// so "1 -5" is number, operator, number
+		return !l.prevIsValue() && l.classify(l.peak()) == catDigit
+	case r == '_' && l.numberUnderscores:
+		// "_1" would otherwise be an identifier; lexNumber rejects it
+		return l.classify(l.peak()) == catDigit
+	case c == catDigit:
+		return !l.dateTimes || dateTimeLen(l.input[l.pos-l.width:]) == 0
+	}
+	return false
+}
+
+// atSpecialFloat reports whether r starts inf, nan or a signed inf
+func (l *lexer) atSpecialFloat(r rune) bool {
+	if !l.specialFloats {
+		return false
+	}
+	word := l.input[l.pos-l.width:]
+	if r == '+' || r == '-' {
+		if l.signsAreOperators || l.prevIsValue() {
+			return false
+		}
+		return l.floatWord(word[1:]) == "inf"
+	}
+	return l.floatWord(word) != ""
+}
+
+// floatWord is the special float name s starts with as a whole word, if any
+func (l *lexer) floatWord(s string) string {
+	if len(s) < 3 {
+		return ""
+	}
+	w := s[:3]
+	if l.foldKeywords {
+		w = strings.ToLower(w)
+	}
+	if w != "inf" && w != "nan" {
+		return ""
+	}
+	r, _ := utf8.DecodeRuneInString(s[3:])
+	if c := l.classify(r); c == catLetter || c == catDigit {
+		return ""
+	}
+	return w
+}
+
+// special float name with an optional sign, value lowercased
+func lexSpecialFloat(l *lexer) stateFn {
+	l.accept("+-")
+	l.advance(3)
+	l.emitValue(itemFloat, strings.ToLower(l.input[l.start:l.pos]))
+	return lexInsideBlock
+}
+
+// operatorLen is the length of the longest configured operator s starts
+// with, 0 for none
+func (l *lexer) operatorLen(s string) int {
+	n := 0
+	for _, op := range l.operators {
+		if len(op) > n && strings.HasPrefix(s, op) {
+			n = len(op)
+		}
+	}
+	return n
+}
+
+// operator, the longest configured one or else a single rune
+func lexOperator(l *lexer) stateFn {
+	if n := l.operatorLen(l.input[l.pos:]); n > 0 {
+		l.advance(n)
+	} else {
+		l.next()
+	}
+	l.emit(itemOperator)
+	return lexInsideBlock
+}
+
+// nest emits an opening (d = +1) or closing (d = -1) bracket, tracking depth
+func (l *lexer) nest(t itemType, d int) stateFn {
+	l.depth = max(l.depth+d, 0)
+	if l.maxNestDepth > 0 && l.depth > l.maxNestDepth {
+		return l.errorf("brackets nested deeper than %d", l.maxNestDepth)
+	}
+	l.emit(t)
+	return lexInsideBlock
+}
+
+// NestDepth is the current bracket nesting depth inside the block
+func (l *lexer) NestDepth() int {
+	return l.depth
+}
+
+// rune categories driving the block dispatch
+type tokenCategory int
+
+const (
+	catOther      tokenCategory = iota // punctuation, or unexpected
+	catWhitespace                      // ignored
+	catDigit                           // starts and continues numbers, continues identifiers
+	catLetter                          // starts and continues identifiers
+	catOperator
+)
+
+func (l *lexer) classify(r rune) tokenCategory {
+	if l.runeClass != nil {
+		return l.runeClass(r)
+	}
+	return l.defaultClass(r)
+}
+
+// defaultClass is the built-in classification, also handy for custom
+// classifiers to fall back on
+func (l *lexer) defaultClass(r rune) tokenCategory {
+	switch {
+	case l.isSpace(r):
+		return catWhitespace
+	case isDigit(r):
+		return catDigit
+	case isIdentStart(r):
+		return catLetter
+	case strings.ContainsRune("+-*%/", r):
+		// the right delimiter is matched before classifying, so a
+		// delimiter like "%>" still wins over the '%' operator
+		return catOperator
+	}
+	return catOther
+}
+
+// isSpace reports whether r is ignorable whitespace inside a block
+// (newlines are handled by the caller)
+func (l *lexer) isSpace(r rune) bool {
+	if r == ' ' || r == '\t' {
+		return true
+	}
+	return l.unicodeWhitespace && r != '\n' && unicode.IsSpace(r)
+}
+
+// blockTooLong reports whether the block's contents have passed maxBlockLen.
+// lexInsideBlock checks between tokens; the states reading tokens of any
+// length (strings, comments, regexes, paths) check as they go, so one long
+// token can't run far past the limit.
+func (l *lexer) blockTooLong() bool {
+	return l.maxBlockLen > 0 && l.blockDepth > 0 && l.pos-l.blockStart > l.maxBlockLen
+}
+
+// block comment, "{{/* c */}}", filling the whole block
+func lexComment(l *lexer) stateFn {
+	n := strings.Index(l.input[l.pos:], "*/")
+	if n < 0 {
+		return l.errorf("unclosed comment")
+	}
+	l.advance(n + len("*/"))
+	if l.blockTooLong() {
+		return l.errorf("block longer than %d bytes", l.maxBlockLen)
+	}
+	l.emit(itemComment)
+	for l.isSpace(l.next()) {
+	}
+	l.backup()
+	l.skip()
+	if !strings.HasPrefix(l.input[l.pos:], l.block.right) && !l.atRightTrim() {
+		return l.errorf("comment ends before closing delimiter")
+	}
+	return lexRightMeta
+}
+
+// comment up to (not including) end of line
+func lexLineComment(l *lexer) stateFn {
+	if i := strings.IndexByte(l.input[l.pos:], '\n'); i >= 0 {
+		l.advance(i)
+	} else {
+		l.advance(len(l.input) - l.pos)
+	}
+	if l.blockTooLong() {
+		return l.errorf("block longer than %d bytes", l.maxBlockLen)
+	}
+	l.emit(itemComment)
+	return lexInsideBlock
+}
+
+// strings, opening quote already consumed. lexInsideBlock only looks for
+// "}}" between tokens, so one inside the quotes is part of the string.
+func lexString(l *lexer) stateFn {
+	var b strings.Builder
+	for {
+		// copy the run up to the next rune that needs a look in one go
+		n := strings.IndexAny(l.input[l.pos:], "\"\\\n")
+		if n < 0 {
+			n = len(l.input) - l.pos
+		}
+		b.WriteString(l.input[l.pos : l.pos+n])
+		l.advance(n)
+		if l.blockTooLong() {
+			return l.errorf("block longer than %d bytes", l.maxBlockLen)
+		}
+		switch r := l.next(); r {
+		case '"':
+			l.emitValue(itemString, b.String())
+			return lexInsideBlock
+		case '\\':
+			switch e := l.next(); e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"':
+				b.WriteRune(e)
+			case '\n':
+				// line continuation: the backslash and newline both drop out
+				if !l.allowMultilineBlocks {
+					return l.errorf("unterminated string")
+				}
+			case 'x', 'u', 'U':
+				r, ok := l.hexEscape(map[rune]int{'x': 2, 'u': 4, 'U': 8}[e])
+				if !ok {
+					return l.errorf("malformed \\%c escape sequence", e)
+				}
+				b.WriteRune(r)
+			case eof:
+				return l.errorf("unterminated string")
+			default:
+				return l.errorf("unknown escape sequence: %#U", e)
+			}
+		case eof:
+			return l.errorf("unterminated string")
+		case '\n':
+			if !l.allowMultilineBlocks {
+				return l.errorf("unterminated string")
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+// raw strings, opening quote already consumed; no escapes
+func lexRawString(l *lexer) stateFn {
+	for {
+		n := strings.IndexAny(l.input[l.pos:], "`\n")
+		if n < 0 {
+			n = len(l.input) - l.pos
+		}
+		l.advance(n)
+		if l.blockTooLong() {
+			return l.errorf("block longer than %d bytes", l.maxBlockLen)
+		}
+		switch l.next() {
+		case '`':
+			l.emitValue(itemRawString, l.input[l.start+1:l.pos-1])
+			return lexInsideBlock
+		case eof:
+			return l.errorf("unterminated raw string")
+		case '\n':
+			if !l.allowMultilineBlocks {
+				return l.errorf("unterminated raw string")
+			}
+		}
+	}
+}
+
+// path up to whitespace or "}}", opening slash already consumed
+func lexPath(l *lexer) stateFn {
+	for !strings.HasPrefix(l.input[l.pos:], l.block.right) {
+		if l.blockTooLong() {
+			return l.errorf("block longer than %d bytes", l.maxBlockLen)
+		}
+		if r := l.next(); r == eof || r == '\n' || l.isSpace(r) {
+			l.backup()
+			break
+		}
+	}
+	l.emit(itemPath)
+	return lexInsideBlock
+}
+
+// regex literals, opening slash already consumed
+func lexRegex(l *lexer) stateFn {
+	for {
+		if strings.HasPrefix(l.input[l.pos:], l.block.right) {
+			return l.errorf("unterminated regex")
+		}
+		if l.blockTooLong() {
+			return l.errorf("block longer than %d bytes", l.maxBlockLen)
+		}
+		switch l.next() {
+		case '/':
+			// flags
+			for r := l.next(); 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z'; r = l.next() {
+			}
+			l.backup()
+			l.emit(itemRegex)
+			return lexInsideBlock
+		case '\\':
+			// keep the escaped rune, "\/" included
+			if r := l.next(); r == eof || r == '\n' {
+				return l.errorf("unterminated regex")
+			}
+		case eof, '\n':
+			return l.errorf("unterminated regex")
+		}
+	}
+}
+
+// hexEscape reads exactly n hex digits as a rune
+func (l *lexer) hexEscape(n int) (rune, bool) {
+	if len(l.input)-l.pos < n {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(l.input[l.pos:l.pos+n], 16, 32)
+	if err != nil || !utf8.ValidRune(rune(v)) {
+		return 0, false
+	}
+	l.advance(n)
+	return rune(v), true
+}
+
+// date/time literals
+func lexDateTime(l *lexer) stateFn {
+	l.advance(dateTimeLen(l.input[l.pos:]))
+	l.emit(itemDateTime)
+	return lexInsideBlock
+}
+
+// dateTimeLen is the length of the date/time literal s starts with, or 0
+func dateTimeLen(s string) int {
+	n := 0
+	if digitsAt(s, 0, 4) && byteAt(s, 4) == '-' && digitsAt(s, 5, 2) && byteAt(s, 7) == '-' && digitsAt(s, 8, 2) {
+		n = 10
+		if t := timeLen(s[min(n+1, len(s)):]); byteAt(s, n) == 'T' && t > 0 {
+			n += 1 + t
+		}
+	} else {
+		n = timeLen(s)
+	}
+	if n == 0 || isDigit(rune(byteAt(s, n))) {
+		return 0
+	}
+	return n
+}
+
+func timeLen(s string) int {
+	if !digitsAt(s, 0, 2) || byteAt(s, 2) != ':' || !digitsAt(s, 3, 2) {
+		return 0
+	}
+	if byteAt(s, 5) == ':' && digitsAt(s, 6, 2) {
+		return 8
+	}
+	return 5
+}
+
+// digitsAt reports whether s[i:i+n] is all ASCII digits
+func digitsAt(s string, i, n int) bool {
+	if i+n > len(s) {
+		return false
+	}
+	for _, c := range []byte(s[i : i+n]) {
+		if !isDigit(rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// byteAt is s[i], or 0 past the end
+func byteAt(s string, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return 0
+}
+
+// numbers
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// prevIsValue reports whether the last emitted item ends an operand
+func (l *lexer) prevIsValue() bool {
+	switch l.prev {
+	case itemIdentifier, itemRightParen, itemRightBrace:
+		return true
+	}
+	return l.prev.IsLiteral()
+}
+
+// identifiers
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// startsIdent reports whether r may start an identifier
+func (l *lexer) startsIdent(r rune) bool {
+	if l.identStart != nil {
+		return l.identStart(r)
+	}
+	return l.classify(r) == catLetter
+}
+
+// continuesIdent reports whether r may follow the start of an identifier
+func (l *lexer) continuesIdent(r rune) bool {
+	if l.identCont != nil {
+		return l.identCont(r)
+	}
+	c := l.classify(r)
+	return c == catLetter || c == catDigit
+}
+
+// identifier, pos back at its start rune
+func lexIdentifier(l *lexer) stateFn {
+	l.next()
+	for l.continuesIdent(l.next()) {
+	}
+	l.backup()
+	val := l.input[l.start:l.pos]
+	if phrase, n := l.phraseAt(val); n > 0 {
+		l.advance(n)
+		l.emitValue(itemKeyword, phrase)
+		return lexInsideBlock
+	}
+	folded := strings.ToLower(val)
+	t := itemIdentifier
+	if l.keywords[val] || l.foldKeywords && l.keywords[folded] {
+		t = itemKeyword
+	}
+	if l.normalizeIdentifiers {
+		val = folded
+	}
+	l.emitValue(t, val)
+	return lexInsideBlock
+}
+
+// phraseAt finds the longest configured phrase starting with word, just
+// read, whose other words follow in the input separated by whitespace. It
+// returns the phrase and how far past word it runs, 0 when none matches.
+func (l *lexer) phraseAt(word string) (string, int) {
+	best, bestLen := "", 0
+	for _, p := range l.phrases {
+		words := strings.Fields(p)
+		if len(words) < 2 || !l.sameWord(words[0], word) {
+			continue
+		}
+		n := 0
+		for _, w := range words[1:] {
+			rest := l.input[l.pos+n:]
+			sp := len(rest) - len(strings.TrimLeftFunc(rest, l.isSpace))
+			end := sp + len(w)
+			if sp == 0 || end > len(rest) || !l.sameWord(w, rest[sp:end]) {
+				n = 0
+				break
+			}
+			if r, _ := utf8.DecodeRuneInString(rest[end:]); l.classify(r) == catLetter || l.classify(r) == catDigit {
+				n = 0
+				break
+			}
+			n += end
+		}
+		if n > bestLen {
+			best, bestLen = strings.Join(words, " "), n
+		}
+	}
+	return best, bestLen
+}
+
+// sameWord compares keyword k to source s, case-insensitively with foldKeywords
+func (l *lexer) sameWord(k, s string) bool {
+	if l.foldKeywords {
+		return strings.EqualFold(k, s)
+	}
+	return k == s
+}
+
+const hexDigits = "0123456789abcdefABCDEF"
+
+func lexNumber(l *lexer) stateFn {
+	if !l.signsAreOperators {
+		l.accept("+-")
+	}
+	sep := ""
+	if l.numberUnderscores {
+		sep = "_"
+	}
+	base := 10
+	if rest := l.input[l.pos:]; len(rest) > 2 && (rest[:2] == "0x" || rest[:2] == "0X") && strings.IndexByte(hexDigits+sep, rest[2]) >= 0 {
+		l.advance(2)
+		l.acceptRun(hexDigits + sep)
+		base = 0 // ParseInt reads the prefix
+	} else {
+		for r := l.next(); l.classify(r) == catDigit || sep != "" && r == '_'; r = l.next() {
+		}
+		l.backup()
+	}
+	val := l.input[l.start:l.pos]
+	if r := l.peak(); l.strictNumberBoundary && l.classify(r) == catLetter {
+		// report where the number ends rather than lexing "12abc" as a
+		// number and an identifier
+		l.ignore()
+		return l.errorf("invalid number suffix: %q", r)
+	}
+	if sep != "" {
+		if strings.HasPrefix(val, sep) || strings.HasSuffix(val, sep) || strings.Contains(val, sep+sep) {
+			return l.errorf("malformed number: %q", val)
+		}
+		val = strings.ReplaceAll(val, sep, "")
+	}
+	if l.normalizeNumbers {
+		val = normalizeNumber(val)
+	}
+	i := l.thisItem(itemNumber, val)
+	if l.checkOverflow {
+		_, err := strconv.ParseInt(val, base, 64)
+		i.overflow = errors.Is(err, strconv.ErrRange)
+	}
+	l.emitItem(i)
+	return lexInsideBlock
+}
+
+// normalizeNumber drops a '+' and leading zeros ("+007" is "7"), and
+// lowercases a hex prefix, without changing the value
+func normalizeNumber(s string) string {
+	sign := ""
+	if s[0] == '+' || s[0] == '-' {
+		sign, s = strings.TrimPrefix(s[:1], "+"), s[1:]
+	}
+	if len(s) > 1 && (s[1] == 'x' || s[1] == 'X') {
+		return sign + "0x" + s[2:]
+	}
+	if s = strings.TrimLeft(s, "0"); s == "" {
+		s = "0"
+	}
+	return sign + s
+}
+
+// helpers
+func (l *lexer) ignore() {
+	l.markStart()
+}
+
+// skip ignores what was read inside a block, keeping it as trivia when
+// attachTrivia is on
+func (l *lexer) skip() {
+	if l.attachTrivia && l.pos > l.start {
+		l.trivia = append(l.trivia, l.input[l.start:l.pos])
+	}
+	l.ignore()
+}
+
+// markStart begins the next item at pos
+func (l *lexer) markStart() {
+	l.start = l.pos
+	l.runeStart = l.runePos
+	l.startLine, l.startCol = l.line, l.col
+}
+
+func (l *lexer) backup() {
+	l.pos -= l.width
+	l.consumed.Store(int64(l.pos))
+	if l.width > 0 {
+		l.runePos--
+		l.line, l.col = l.prevLine, l.prevCol
+	}
+}
+
+// advance moves n bytes forward through next, keeping the counters in step
+func (l *lexer) advance(n int) {
+	for end := l.pos + n; l.pos < end; {
+		l.next()
+	}
+}
+
+// get next rune, but rewind (backup)
+func (l *lexer) peak() rune {
+	r := l.next()
+	l.backup()
+	return r
+}
+
+// check if next rune is in valid range
+func (l *lexer) accept(valid string) bool {
+	if strings.IndexRune(valid, l.next()) >= 0 {
+		return true
+	}
+	// otherwise rewind and deny
+	l.backup()
+	return false
+}
+
+// read until no longer valid
+func (l *lexer) acceptRun(valid string) {
+	for strings.IndexRune(valid, l.next()) >= 0 {
+	}
+	// unwanted rune reached, rewind
+	l.backup()
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) stateFn {
+	msg := fmt.Sprintf(format, args...)
+	if l.errorSnippet {
+		msg += fmt.Sprintf(" near %q", l.snippet(snippetRadius))
+	}
+	l.diagnose(SeverityError, msg)
+	// throw error over the fence
+	l.send(item{typ: itemError, val: msg, pos: l.startPos(), line: l.startLine, col: l.startCol})
+	// followed by an EOF flagged as unclean
+	l.errored = true
+	l.send(item{typ: itemEOF, pos: l.startPos(), line: l.startLine, col: l.startCol, afterError: true})
+	// abort state machine
+	return nil
+}
+
+// warnf records a warning and lets lexing carry on
+func (l *lexer) warnf(format string, args ...interface{}) {
+	l.diagnose(SeverityWarning, fmt.Sprintf(format, args...))
+}
+
+func (l *lexer) diagnose(sev Severity, msg string) {
+	l.diagnostics = append(l.diagnostics, Diagnostic{sev, msg, l.startPos(), l.startLine, l.startCol})
+}
+
+// Severity of a Diagnostic
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Diagnostic is a problem found while lexing, at the start of the item
+// being lexed
+type Diagnostic struct {
+	Severity  Severity
+	Msg       string
+	Pos       int
+	Line, Col int
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s: %s", d.Line, d.Col, d.Severity, d.Msg)
+}
+
+// Diagnostics returns the warnings and errors so far; in goroutine mode
+// only read it after EOF
+func (l *lexer) Diagnostics() []Diagnostic {
+	return l.diagnostics
+}
+
+const snippetRadius = 10
+
+// snippet returns up to n bytes either side of pos, widened to rune boundaries
+func (l *lexer) snippet(n int) string {
+	lo, hi := max(l.pos-n, 0), min(l.pos+n, len(l.input))
+	for lo > 0 && !utf8.RuneStart(l.input[lo]) {
+		lo--
+	}
+	for hi < len(l.input) && !utf8.RuneStart(l.input[hi]) {
+		hi++
+	}
+	return l.input[lo:hi]
+}
+
+// API for traversing and/or parsing
+
+// return new scanner
+func NewScanner(name, input string) *lexer {
+	l := &lexer{
+		name:        name,
+		input:       input,
+		state:       lexText,
+		leftDelim:   DefaultLeftDelim,
+		rightDelim:  DefaultRightDelim,
+		delimEscape: `\`,
+		line:        1,
+		col:         1,
+		startLine:   1,
+		startCol:    1,
+		items:       make(chan item, DefaultBufferSize), // might not be needed here, but no reason to let memory go above what's needed
+	}
+	l.subLexers = l.builtinSubLexers()
+	l.size.Store(int64(len(input)))
+	return l
+}
+
+// Encoding of raw input handed to NewScannerEncoding
+type Encoding int
+
+const (
+	EncodingUTF8  Encoding = iota
+	EncodingUTF16          // byte order from the BOM, big endian without one
+	EncodingUTF16LE
+	EncodingUTF16BE
+)
+
+// NewScannerBytes returns a new scanner reading input in place instead of
+// copying it into a string: runes are decoded from input, and prefix and
+// delimiter matching read a string sharing its memory. Item values that are
+// source text share it too, so input must not change while they're in use.
+func NewScannerBytes(name string, input []byte) *lexer {
+	l := NewScanner(name, unsafe.String(unsafe.SliceData(input), len(input)))
+	l.src = input
+	return l
+}
+
+// return new scanner over data in the given encoding. The input is decoded
+// to UTF-8 (dropping any BOM) up front, so positions are offsets into the
+// decoded UTF-8 text, not into data.
+func NewScannerEncoding(name string, data []byte, enc Encoding) *lexer {
+	return NewScanner(name, decode(data, enc))
+}
+
+func decode(data []byte, enc Encoding) string {
+	if enc == EncodingUTF8 {
+		return strings.TrimPrefix(string(data), "\uFEFF")
+	}
+	bigEndian := enc != EncodingUTF16LE
+	if len(data) >= 2 && enc != EncodingUTF16BE && data[0] == 0xFF && data[1] == 0xFE {
+		bigEndian, data = false, data[2:]
+	} else if len(data) >= 2 && enc != EncodingUTF16LE && data[0] == 0xFE && data[1] == 0xFF {
+		bigEndian, data = true, data[2:]
+	}
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+		} else {
+			units = append(units, uint16(data[i+1])<<8|uint16(data[i]))
+		}
+	}
+	decoded := string(utf16.Decode(units))
+	if len(data)%2 != 0 {
+		// dangling byte
+		decoded += string(utf8.RuneError)
+	}
+	return decoded
+}
+
+// NewScannerBuffer is NewScanner buffering size items, any size including 0.
+// Items a state emits beyond the buffer are queued, so the order is the same
+// whatever the size.
+func NewScannerBuffer(name, input string, size int) *lexer {
+	l := NewScanner(name, input)
+	l.items = make(chan item, size)
+	return l
+}
+
+// NewNumberScanner returns a scanner whose blocks may only hold decimal
+// numbers separated by spaces, lexed by a single state instead of the
+// general block dispatch
+func NewNumberScanner(name, input string) *lexer {
+	l := NewScanner(name, input)
+	l.numbersOnly = true
+	return l
+}
+
+// return new scanner whose state machine runs in its own goroutine, started
+// by the first nextItem (so options can still be set). Call Close when
+// stopping before EOF, otherwise the goroutine stays blocked on send.
+func NewConcurrentScanner(name, input string) *lexer {
+	l := NewScanner(name, input)
+	l.done = make(chan struct{})
+	return l
+}
+
+// return new scanner that never touches a goroutine or channel: each
+// NextItem runs state functions inline, only while nothing is queued
+func NewSyncScanner(name, input string) *lexer {
+	l := NewScanner(name, input)
+	l.items = nil
+	l.sync = true
+	return l
+}
+
+// run drives the state machine until it terminates or Close is called
+func (l *lexer) run() {
+	defer close(l.items)
+	for l.state != nil {
+		select {
+		case <-l.done:
+			return
+		default:
+			l.step()
+		}
+	}
+}
+
+// step runs the current state function once
+func (l *lexer) step() {
+	from := l.state
+	l.state = from(l)
+	if l.onTransition != nil {
+		l.onTransition(stateName(from), stateName(l.state))
+	}
+}
+
+// stateName is the function name of a state, "" for nil
+func stateName(s stateFn) string {
+	if s == nil {
+		return ""
+	}
+	name := runtime.FuncForPC(reflect.ValueOf(s).Pointer()).Name()
+	return name[strings.LastIndexByte(name, '.')+1:]
+}
+
+// OnTransition sets fn to be called after each state function returns, with
+// the names of that state and the next one ("" once the lexer terminates).
+// A concurrent scanner calls fn from its lexing goroutine.
+func (l *lexer) OnTransition(fn func(from, to string)) {
+	l.onTransition = fn
+}
+
+// Close stops the lexer early, discarding unread items. nextItem after
+// Close returns an EOF item.
+func (l *lexer) Close() {
+	l.peeked = false
+	l.injected = nil
+	if l.done == nil {
+		l.state = nil
+		l.pending, l.head = nil, 0
+		for len(l.items) > 0 {
+			<-l.items
+		}
+		return
+	}
+	select {
+	case <-l.done:
+		return // already closed
+	default:
+		close(l.done)
+	}
+	if !l.started {
+		l.started = true
+		close(l.items)
+		return
+	}
+	// wait for run to notice and exit
+	for range l.items {
+	}
+}
+func (l *lexer) next() (r rune) {
+	// check if end has been reached
+	if l.pos >= len(l.input) {
+		l.width = 0 // so a backup after eof stays put
+		return eof
+	}
+	// read next rune
+	if l.src != nil {
+		r, l.width = utf8.DecodeRune(l.src[l.pos:])
+	} else {
+		r, l.width = utf8.DecodeRuneInString(l.input[l.pos:])
+	}
+	l.pos += l.width
+	l.consumed.Store(int64(l.pos))
+	l.runePos++
+	l.prevLine, l.prevCol = l.line, l.col
+	switch r {
+	case '\n':
+		l.line++
+		l.col = 1
+	case '\t':
+		tab := max(l.tabWidth, 1)
+		l.col = (l.col-1)/tab*tab + tab + 1
+	default:
+		l.col++
+	}
+	return r
+}
+
+// AtEOF reports whether all input has been consumed. From then on next
+// returns eof on every call without moving, leaving width 0 so backup is a
+// no-op; eof is -1, outside any rune a wrapping lexer reads from the input.
+func (l *lexer) AtEOF() bool {
+	return l.pos >= len(l.input)
+}
+
+// Progress is the fraction of input consumed so far (1 for empty input).
+// It's safe to call while a concurrent scanner is running.
+func (l *lexer) Progress() float64 {
+	size := l.size.Load()
+	if size == 0 {
+		return 1
+	}
+	return float64(l.consumed.Load()) / float64(size)
+}
+
+// RemainingBytes is the amount of input not yet consumed, safe to call while
+// a concurrent scanner is running
+func (l *lexer) RemainingBytes() int {
+	return int(l.size.Load() - l.consumed.Load())
+}
+
+// NextItem returns the next item, running the lexer as far as needed
+func (l *lexer) NextItem() item {
+	return l.nextItem()
+}
+
+// Scanner is the item stream a parser consumes
+type Scanner interface {
+	Next() item // next item, EOF once the input is exhausted
+	Peek() item // what Next will return, without consuming it
+	Close()     // stop early, discarding unread items
+}
+
+var _ Scanner = (*lexer)(nil)
+
+// Next is NextItem, for Scanner
+func (l *lexer) Next() item {
+	return l.nextItem()
+}
+
+// Peek returns the next item and keeps it for the following read
+func (l *lexer) Peek() item {
+	if !l.peeked {
+		l.peek, l.peeked = l.nextItem(), true
+	}
+	return l.peek
+}
+
+// Count is how many items of type t the lexer has emitted so far, safe to
+// call while a concurrent scanner is running. Only the built-in kinds are
+// counted.
+func (l *lexer) Count(t itemType) int {
+	if t < 0 || t >= numItemTypes {
+		return 0
+	}
+	return int(l.counts[t].Load())
+}
+
+// Inject queues i, flagged as synthetic, to be read ahead of the items not
+// lexed yet. Injected items come out in the order they went in, after any
+// item Peek already holds.
+func (l *lexer) Inject(i item) {
+	i.synthetic = true
+	l.injected = append(l.injected, i)
+}
+
+// NextUntil reads items up to the first one of type stop, or EOF. That one
+// is left unread, so Next returns it to take it too.
+func (l *lexer) NextUntil(stop itemType) []item {
+	var items []item
+	for i := l.Peek(); i.typ != stop && i.typ != itemEOF; i = l.Peek() {
+		items = append(items, l.Next())
+	}
+	return items
+}
+
+// IsRuneBoundary reports whether byte offset pos starts a rune in the input
+// (both ends of the input count, anything outside doesn't)
+func (l *lexer) IsRuneBoundary(pos int) bool {
+	if pos < 0 || pos > len(l.input) {
+		return false
+	}
+	return pos == len(l.input) || utf8.RuneStart(l.input[pos])
+}
+
+// state machine
+func (l *lexer) nextItem() item {
+	if l.peeked {
+		l.peeked = false
+		return l.peek
+	}
+	i, ok := l.receive()
+	if !ok {
+		// terminated (EOF, error or Close)
+		return item{typ: itemEOF, afterError: l.errored}
+	}
+	if l.recordItems {
+		l.recorded = append(l.recorded, i)
+	}
+	if i.typ == itemError || i.typ == itemIllegal {
+		l.errs = append(l.errs, i)
+	}
+	return i
+}
+
+// Errors runs the lexer to completion and returns every error and illegal
+// item of the run, including those already read
+func (l *lexer) Errors() []item {
+	for l.nextItem().typ != itemEOF {
+	}
+	return l.errs
+}
+
+// receive gets the next item from whichever model drives the lexer, false
+// once it has terminated and everything was delivered
+func (l *lexer) receive() (item, bool) {
+	if len(l.injected) > 0 {
+		i := l.injected[0]
+		l.injected = l.injected[1:]
+		return i, true
+	}
+	if l.sync {
+		if l.head == len(l.pending) {
+			// drained, reuse the backing array
+			l.pending, l.head = l.pending[:0], 0
+		}
+		for len(l.pending) == 0 {
+			if l.state == nil {
+				return item{}, false
+			}
+			l.step()
+		}
+		i := l.pending[l.head]
+		l.head++
+		return i, true
+	}
+	if l.done != nil {
+		if !l.started {
+			l.started = true
+			go l.run()
+		}
+		i, ok := <-l.items
+		return i, ok
+	}
+	for {
+		select {
+		case i := <-l.items:
+			return i, true
+		default:
+			if l.head < len(l.pending) {
+				i := l.pending[l.head]
+				l.head++
+				return i, true
+			}
+			l.pending, l.head = l.pending[:0], 0
+			if l.state == nil {
+				return item{}, false
+			}
+			l.step()
+		}
+	}
+}
+
+// Recorded returns every item delivered so far (recordItems only)
+func (l *lexer) Recorded() []item {
+	return l.recorded
+}
+
+// lexError turns an error item into an error
+func lexError(i item) error {
+	return errors.New(i.val)
+}
+
+// Scan runs the lexer, handing each item up to and including EOF to fn
+// until fn returns false. A lex error stops the scan and is returned.
+func (l *lexer) Scan(fn func(item) bool) error {
+	for {
+		i := l.nextItem()
+		if i.typ == itemError {
+			return lexError(i)
+		}
+		if !fn(i) {
+			l.Close()
+			return nil
+		}
+		if i.typ == itemEOF {
+			return nil
+		}
+	}
+}
+
+// WriteTokens runs the lexer, writing each item as "TYPE\tVALUE\n" (value quoted)
+func (l *lexer) WriteTokens(w io.Writer) error {
+	for {
+		i := l.nextItem()
+		if _, err := fmt.Fprintf(w, "%s\t%q\n", i.typ, i.Value()); err != nil {
+			return err
+		}
+		switch i.typ {
+		case itemEOF:
+			return nil
+		case itemError:
+			return lexError(i)
+		}
+	}
+}
+
+// Dump runs the lexer, writing a table of the items: index, type,
+// line:col and quoted value
+func (l *lexer) Dump(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tTYPE\tPOS\tVALUE")
+	for n := 0; ; n++ {
+		i := l.nextItem()
+		fmt.Fprintf(tw, "%d\t%s\t%d:%d\t%q\n", n, i.typ, i.line, i.col, i.Value())
+		switch i.typ {
+		case itemEOF:
+			return tw.Flush()
+		case itemError:
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			return lexError(i)
+		}
+	}
+}
+
+// Tokenize runs the lexer to completion, collecting every item up to and
+// including EOF. A lex error ends the run, returning the items so far.
+func (l *lexer) Tokenize() ([]item, error) {
+	var items []item
+	for {
+		if l.maxItems > 0 && len(items) >= l.maxItems {
+			return items, fmt.Errorf("too many items: limit is %d", l.maxItems)
+		}
+		i := l.nextItem()
+		if i.typ == itemError {
+			return items, lexError(i)
+		}
+		items = append(items, i)
+		if i.typ == itemEOF {
+			return items, nil
+		}
+	}
+}
+
+// Lex tokenizes input with the default options
+func Lex(name, input string) ([]item, error) {
+	return LexN(name, input, 0)
+}
+
+// LexN is Lex stopping with an error once maxItems items are collected
+// (0 = unlimited), for input that may be adversarial
+func LexN(name, input string, maxItems int) ([]item, error) {
+	l := NewScanner(name, input)
+	l.maxItems = maxItems
+	return l.Tokenize()
+}
+
+// Validate lexes input, returning the first error
+func Validate(name, input string) error {
+	_, err := NewSyncScanner(name, input).Tokenize()
+	return err
+}
+
+// ValidateAll lexes input in recoverErrors mode and returns every illegal
+// rune, and the error that ended the run if any, as "name:line:col: msg"
+func ValidateAll(name, input string) []error {
+	l := NewSyncScanner(name, input)
+	l.recoverErrors = true
+	var errs []error
+	for _, i := range l.Errors() {
+		msg := i.val
+		if i.typ == itemIllegal {
+			msg = fmt.Sprintf("unexpected char in block: %q", i.val)
+		}
+		errs = append(errs, fmt.Errorf("%s:%d:%d: %s", name, i.line, i.col, msg))
+	}
+	return errs
+}
+
+// Reconstruct concatenates the items' source text back into the input.
+// It only round-trips when nothing was dropped: whitespace and comments
+// skipped inside blocks are lost unless attachTrivia kept them on the items.
+func Reconstruct(items []item) (string, error) {
+	var b strings.Builder
+	for _, i := range items {
+		if i.typ == itemError {
+			return b.String(), lexError(i)
+		}
+		for _, t := range i.leadingTrivia {
+			b.WriteString(t)
+		}
+		b.WriteString(i.Raw())
+	}
+	return b.String(), nil
+}
+
+// LexDocuments lexes each sep-separated document in input from a fresh
+// state, tagging items with their document index. Only the final EOF is kept.
+func LexDocuments(name, input, sep string) ([]item, error) {
+	var all []item
+	docs := strings.Split(input, sep)
+	for n, doc := range docs {
+		items, err := Lex(name, doc)
+		for _, i := range items {
+			if i.typ == itemEOF && n < len(docs)-1 {
+				continue
+			}
+			i.doc = n
+			all = append(all, i)
+		}
+		if err != nil {
+			return all, fmt.Errorf("document %d: %w", n, err)
+		}
+	}
+	return all, nil
+}
+
+// StripComments removes comment blocks ("{{/* c */}}") from input. mapper
+// turns an offset in clean into the offset it came from in input. Stripping
+// stops at the first lex error, leaving the rest of input as it is.
+func StripComments(input string) (clean string, mapper func(int) int) {
+	type cut struct{ at, n int } // n bytes removed at offset at in clean
+	var cuts []cut
+	var b strings.Builder
+	copied := 0 // input before this is in b or cut
+	l := NewSyncScanner("strip", input)
+	var left item
+	for i := l.nextItem(); i.typ != itemEOF && i.typ != itemError; i = l.nextItem() {
+		switch i.typ {
+		case itemLeftMeta:
+			left = i
+		case itemComment:
+			if l.Peek().typ != itemRightMeta || left.endPos != i.pos {
+				continue
+			}
+			end := l.Next().endPos
+			b.WriteString(input[copied:left.pos])
+			cuts = append(cuts, cut{b.Len(), end - left.pos})
+			copied = end
+		}
+	}
+	b.WriteString(input[copied:])
+	return b.String(), func(pos int) int {
+		orig := pos
+		for _, c := range cuts {
+			if c.at <= pos {
+				orig += c.n
+			}
+		}
+		return orig
+	}
+}
+
+// Segment is either literal text or a block's contents
+type Segment struct {
+	Block bool   // block (Items) rather than text (Text)
+	Text  string // literal text
+	Items []item // items between the block's delimiters
+}
+
+// Segments splits input into text and block segments
+func Segments(name, input string) ([]Segment, error) {
+	items, err := Lex(name, input)
+	if err != nil {
+		return nil, err
+	}
+	var segs []Segment
+	inBlock := false
+	for _, i := range items {
+		switch {
+		case i.typ == itemLeftMeta:
+			segs = append(segs, Segment{Block: true})
+			inBlock = true
+		case i.typ == itemRightMeta:
+			inBlock = false
+		case inBlock:
+			segs[len(segs)-1].Items = append(segs[len(segs)-1].Items, i)
+		case i.typ == itemText:
+			segs = append(segs, Segment{Text: i.val})
+		}
+	}
+	return segs, nil
+}
+
+// readInput returns the text to lex and its name: arg itself, or with isFile
+// the contents of the file arg names
+func readInput(arg string, isFile bool) (name, text string, err error) {
+	if !isFile {
+		return "number lexer", arg, nil
+	}
+	data, err := os.ReadFile(arg)
+	if err != nil {
+		return "", "", err
+	}
+	return arg, string(data), nil
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run is the command behind main, returning its exit code: 1 when the
+// input fails to read or lex, 2 for bad usage
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("lex", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	format := flags.String("format", "text", "output format: text or json")
+	isFile := flags.Bool("file", false, "the argument names a file to lex rather than the input itself")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	name, input, err := readInput(flags.Arg(0), *isFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	s := NewScanner(name, input)
+	switch *format {
+	case "text":
+		fmt.Fprintf(stdout, "lexing %.100q...\n", input)
+		for {
+			switch i := s.nextItem(); i.typ {
+			case itemEOF:
+				return 0
+			case itemError:
+				fmt.Fprintf(stderr, "%s:%d:%d: %s\n", name, i.line, i.col, i.val)
+				return 1
+			default:
+				fmt.Fprintln(stdout, i)
+			}
+		}
+	case "json":
+		var items []item
+		for {
+			i := s.nextItem()
+			if i.typ == itemError {
+				fmt.Fprintf(stderr, "%s:%d:%d: %s\n", name, i.line, i.col, i.val)
+				return 1
+			}
+			items = append(items, i)
+			if i.typ == itemEOF {
+				break
+			}
+		}
+		out, err := json.Marshal(items)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fmt.Fprintln(stdout, string(out))
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown format %q\n", *format)
+		return 2
 	}
 }
@@ -0,0 +1,1287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf16"
+)
+
+// lexTest is an input and the items it lexes to, compared by kind and value
+type lexTest struct {
+	name  string
+	input string
+	opts  func(l *lexer) // options set before the first item, nil for the defaults
+	items []item
+}
+
+func mkItem(typ itemType, val string) item {
+	return item{typ: typ, val: val}
+}
+
+var (
+	tEOF   = mkItem(itemEOF, "")
+	tLeft  = mkItem(itemLeftMeta, "{{")
+	tRight = mkItem(itemRightMeta, "}}")
+)
+
+func tNum(s string) item   { return mkItem(itemNumber, s) }
+func tIdent(s string) item { return mkItem(itemIdentifier, s) }
+func tOp(s string) item    { return mkItem(itemOperator, s) }
+func tText(s string) item  { return mkItem(itemText, s) }
+func tStr(s string) item   { return mkItem(itemString, s) }
+func tErr(s string) item   { return mkItem(itemError, s) }
+
+// block is the items of input that is a lone "{{ ... }}" holding inner
+func block(inner ...item) []item {
+	return append(append([]item{tLeft}, inner...), tRight, tEOF)
+}
+
+var lexTests = []lexTest{
+	{"empty", "", nil, []item{tEOF}},
+	{"text", "a", nil, []item{tText("a"), tEOF}},
+	{"number", "a{{ 1 }}b", nil, []item{tText("a"), tLeft, tNum("1"), tRight, tText("b"), tEOF}},
+	{"bad char", "{{ # }}", nil, []item{tLeft, tErr("unexpected char in block: U+0023 '#'")}},
+	{"unclosed", "{{ 1", nil, []item{tLeft, tNum("1"), tErr("unclosed block")}},
+	{"no spaces", "{{1}}", nil, block(tNum("1"))},
+	{"no spaces sign", "{{-12}}x", nil, []item{tLeft, tNum("-12"), tRight, tText("x"), tEOF}},
+	{"no space before close", "a{{ 1}}b", nil, []item{tText("a"), tLeft, tNum("1"), tRight, tText("b"), tEOF}},
+	{"no space after open", "{{1 2}}", nil, block(tNum("1"), tNum("2"))},
+	{"back to back", "{{1}}{{2}}", nil, []item{tLeft, tNum("1"), tRight, tLeft, tNum("2"), tRight, tEOF}},
+	{"string at close", `{{"a"}}`, nil, block(tStr("a"))},
+	{"identifier at close", "{{ab}}", nil, block(tIdent("ab"))},
+	{"paren at close", "{{(1)}}c", nil, []item{tLeft, mkItem(itemLeftParen, "("), tNum("1"), mkItem(itemRightParen, ")"), tRight, tText("c"), tEOF}},
+
+	// signs
+	{"negative", "{{ -5 }}", nil, block(tNum("-5"))},
+	{"subtract", "{{ 1 - 5 }}", nil, block(tNum("1"), tOp("-"), tNum("5"))},
+	{"subtract unspaced", "{{ 1 -5 }}", nil, block(tNum("1"), tOp("-"), tNum("5"))},
+	{"lone signs", "{{ - - - - }}", nil, block(tOp("-"), tOp("-"), tOp("-"), tOp("-"))},
+	{"signs are operators", "{{ -5 }}", func(l *lexer) { l.signsAreOperators = true }, block(tOp("-"), tNum("5"))},
+
+	{"line comment", "{{\n1 // x\n2\n}}", func(l *lexer) {
+		l.allowMultilineBlocks = true
+		l.lineCommentMarker = "//"
+	}, block(tNum("1"), mkItem(itemComment, "// x"), tNum("2"))},
+	{"line comment single line", "{{ 1 # 2 }}", func(l *lexer) { l.lineCommentMarker = "#" }, []item{tLeft, tNum("1"), tErr("unexpected char in block: U+0023 '#'")}},
+	{"newline in block", "{{\n1}}", nil, []item{tLeft, tErr("unclosed block")}},
+
+	{"unicode space", "{{ 1\u00a02 }}", func(l *lexer) { l.unicodeWhitespace = true }, block(tNum("1"), tNum("2"))},
+	{"unicode space off", "{{ 1\u00a02 }}", nil, []item{tLeft, tNum("1"), tErr("unexpected char in block: U+00A0")}},
+
+	{"block markers", "{{ 1 }}", func(l *lexer) { l.blockMarkers = true },
+		block(mkItem(itemBlockStart, ""), tNum("1"), mkItem(itemBlockEnd, ""))},
+
+	{"error snippet", "some text {{ 1 # }} more text", func(l *lexer) { l.errorSnippet = true },
+		[]item{tText("some text "), tLeft, tNum("1"), tErr(`unexpected char in block: U+0023 '#' near "ext {{ 1 # }} more t"`)}},
+	{"error snippet runes", "ééééééé{{#", func(l *lexer) { l.errorSnippet = true },
+		[]item{tText("ééééééé"), tLeft, tErr(`unexpected char in block: U+0023 '#' near "éééé{{#"`)}},
+
+	{"braces", "{{ {a:1} }}", nil, block(mkItem(itemLeftBrace, "{"), tIdent("a"), mkItem(itemColon, ":"), tNum("1"), mkItem(itemRightBrace, "}"))},
+	{"left delim in block", "{{ {{ }}", nil, []item{tLeft, tErr("unexpected left delimiter in block")}},
+
+	// strings
+	{"string", `ab{{ "x\"y\n" }}`, nil, []item{tText("ab"), tLeft, tStr("x\"y\n"), tRight, tEOF}},
+	{"unterminated string", `{{ "x`, nil, []item{tLeft, tErr("unterminated string")}},
+	{"delim in string", `{{ "a}}b" }}`, nil, block(tStr("a}}b"))},
+	{"delim in raw string", "{{ `a}}b` }}", nil, block(mkItem(itemRawString, "a}}b"))},
+	{"hex escapes", `{{ "café \x41\U0001F600" }}`, nil, block(tStr("café A😀"))},
+	{"unicode escape", `{{ "\u00e9" }}`, nil, block(tStr("é"))},
+	{"short unicode escape", `{{ "\u12" }}`, nil, []item{tLeft, tErr(`malformed \u escape sequence`)}},
+	{"bad unicode escape", `{{ "\uGGGG" }}`, nil, []item{tLeft, tErr(`malformed \u escape sequence`)}},
+	{"signed unicode escape", `{{ "\u+123" }}`, nil, []item{tLeft, tErr(`malformed \u escape sequence`)}},
+	{"invalid rune escape", `{{ "\UFFFFFFFF" }}`, nil, []item{tLeft, tErr(`malformed \U escape sequence`)}},
+	{"escapes", `{{ "a\tb\"c\\dé" "" "x\n" }}`, nil, block(tStr("a\tb\"c\\dé"), tStr(""), tStr("x\n"))},
+	{"raw string", "{{ `a\\b` }}", nil, block(mkItem(itemRawString, `a\b`))},
+	{"raw string newline", "{{ `a\n` }}", nil, []item{tLeft, tErr("unterminated raw string")}},
+	{"multiline raw string", "{{ `a\n` }}", func(l *lexer) { l.allowMultilineBlocks = true }, block(mkItem(itemRawString, "a\n"))},
+	{"string continuation", "{{ \"ab\\\ncd\" 1 }}", func(l *lexer) { l.allowMultilineBlocks = true }, block(tStr("abcd"), tNum("1"))},
+	{"string continuation single line", "{{ \"ab\\\ncd\" }}", nil, []item{tLeft, tErr("unterminated string")}},
+
+	{"overflow", "{{ 123456789012345678901234567890 }}", func(l *lexer) { l.checkOverflow = true }, block(tNum("123456789012345678901234567890"))},
+	{"rune class", "{{ $x }}", func(l *lexer) {
+		l.runeClass = func(r rune) tokenCategory {
+			if r == '$' {
+				return catLetter
+			}
+			return l.defaultClass(r)
+		}
+	}, block(tIdent("$x"))},
+
+	// punctuation
+	{"call", "{{ f(1, 2) -1 }}", nil, block(tIdent("f"), mkItem(itemLeftParen, "("), tNum("1"), mkItem(itemComma, ","), tNum("2"),
+		mkItem(itemRightParen, ")"), tOp("-"), tNum("1"))},
+	{"ignore runes", "{{ 1, 2 }}", func(l *lexer) { l.ignoreRunes = "," }, block(tNum("1"), tNum("2"))},
+	{"semicolon", "{{ 1; 2 }}", nil, block(tNum("1"), mkItem(itemSemicolon, ";"), tNum("2"))},
+	{"semicolon sign", "{{ 1; -2 }}", nil, block(tNum("1"), mkItem(itemSemicolon, ";"), tNum("-2"))},
+	{"ternary", "{{ a ? b : c }}", nil, block(tIdent("a"), mkItem(itemQuestion, "?"), tIdent("b"), mkItem(itemColon, ":"), tIdent("c"))},
+	{"assign", "{{ x = 1 }}", nil, block(tIdent("x"), mkItem(itemAssign, "="), tNum("1"))},
+	{"declare", "{{ x := 1 }}", nil, block(tIdent("x"), mkItem(itemDeclare, ":="), tNum("1"))},
+	{"compare", "{{ x == 1 ? a : b }}", nil, block(tIdent("x"), tOp("=="), tNum("1"), mkItem(itemQuestion, "?"), tIdent("a"), mkItem(itemColon, ":"), tIdent("b"))},
+	{"attributes", `{{ button class="x" }}`, nil, block(tIdent("button"), tIdent("class"), mkItem(itemAssign, "="), tStr("x"))},
+	{"bare attribute", `{{ button class="x" disabled data-id=1 }}`, nil, block(tIdent("button"), tIdent("class"), mkItem(itemAssign, "="), tStr("x"),
+		tIdent("disabled"), tIdent("data"), tOp("-"), tIdent("id"), mkItem(itemAssign, "="), tNum("1"))},
+	{"decorator", "{{ @cache(10) }}", nil, block(mkItem(itemAt, "@"), tIdent("cache"), mkItem(itemLeftParen, "("), tNum("10"), mkItem(itemRightParen, ")"))},
+	{"decorator letter", "{{ @cache }}", func(l *lexer) {
+		l.runeClass = func(r rune) tokenCategory {
+			if r == '@' {
+				return catLetter
+			}
+			return l.defaultClass(r)
+		}
+	}, block(tIdent("@cache"))},
+
+	// numbers
+	{"disable numbers", "{{ 123abc -1 }}", func(l *lexer) { l.disableNumbers = true }, block(tIdent("123abc"), tOp("-"), tIdent("1"))},
+	{"percent", "{{ 5 % 2 }}", nil, block(tNum("5"), tOp("%"), tNum("2"))},
+	{"multiply", "{{ 2 * 3 + 1 }}", nil, block(tNum("2"), tOp("*"), tNum("3"), tOp("+"), tNum("1"))},
+	{"normalize numbers", "{{ +007 0X1F 000 (-0012) 5 0x }}", func(l *lexer) { l.normalizeNumbers = true },
+		block(tNum("7"), tNum("0x1F"), tNum("0"), mkItem(itemLeftParen, "("), tNum("-12"), mkItem(itemRightParen, ")"), tNum("5"), tNum("0"), tIdent("x"))},
+	{"underscores", "{{ 1_000 }}", func(l *lexer) { l.numberUnderscores = true }, block(tNum("1000"))},
+	{"hex underscores", "{{ 0x_FF }}", func(l *lexer) { l.numberUnderscores = true }, block(tNum("0xFF"))},
+	{"double underscore", "{{ 1__0 }}", func(l *lexer) { l.numberUnderscores = true }, []item{tLeft, tErr(`malformed number: "1__0"`)}},
+	{"trailing underscore", "{{ 1_ }}", func(l *lexer) { l.numberUnderscores = true }, []item{tLeft, tErr(`malformed number: "1_"`)}},
+	{"leading underscore", "{{ _1 }}", func(l *lexer) { l.numberUnderscores = true }, []item{tLeft, tErr(`malformed number: "_1"`)}},
+	{"underscore identifier", "{{ _x x_1 }}", func(l *lexer) { l.numberUnderscores = true }, block(tIdent("_x"), tIdent("x_1"))},
+	{"underscores off", "{{ 1_000 }}", nil, block(tNum("1"), tIdent("_000"))},
+	{"strict number boundary", "{{ 12abc }}", func(l *lexer) { l.strictNumberBoundary = true }, []item{tLeft, tErr("invalid number suffix: 'a'")}},
+	{"number boundary", "{{ 12abc }}", nil, block(tNum("12"), tIdent("abc"))},
+	{"inf", "{{ inf }}", func(l *lexer) { l.specialFloats = true }, block(mkItem(itemFloat, "inf"))},
+	{"nan", "{{ nan }}", func(l *lexer) { l.specialFloats = true }, block(mkItem(itemFloat, "nan"))},
+	{"negative inf", "{{ -inf }}", func(l *lexer) { l.specialFloats = true }, block(mkItem(itemFloat, "-inf"))},
+	{"minus inf", "{{ 1 -inf }}", func(l *lexer) { l.specialFloats = true }, block(tNum("1"), tOp("-"), mkItem(itemFloat, "inf"))},
+	{"float words", "{{ info INF }}", func(l *lexer) { l.specialFloats = true }, block(tIdent("info"), tIdent("INF"))},
+	{"folded inf", "{{ -INF }}", func(l *lexer) { l.specialFloats, l.foldKeywords = true, true }, block(mkItem(itemFloat, "-inf"))},
+
+	// date/times
+	{"date", "{{ 2023-01-02 }}", func(l *lexer) { l.dateTimes = true }, block(mkItem(itemDateTime, "2023-01-02"))},
+	{"time", "{{ 12:30 }}", func(l *lexer) { l.dateTimes = true }, block(mkItem(itemDateTime, "12:30"))},
+	{"date time", "{{ 2023-01-02T12:30:59 }}", func(l *lexer) { l.dateTimes = true }, block(mkItem(itemDateTime, "2023-01-02T12:30:59"))},
+	{"date T", "{{ 2023-01-02T }}", func(l *lexer) { l.dateTimes = true }, block(mkItem(itemDateTime, "2023-01-02"), tIdent("T"))},
+	{"not a date", "{{ 2023-1 }}", func(l *lexer) { l.dateTimes = true }, block(tNum("2023"), tOp("-"), tNum("1"))},
+	{"not a time", "{{ 12:300 }}", func(l *lexer) { l.dateTimes = true }, block(tNum("12"), mkItem(itemColon, ":"), tNum("300"))},
+
+	// limits
+	{"max block len", "{{ 1 }}{{ 1 2 3 4 5 6 }}", func(l *lexer) { l.maxBlockLen = 5 },
+		[]item{tLeft, tNum("1"), tRight, tLeft, tNum("1"), tNum("2"), tNum("3"), tErr("block longer than 5 bytes")}},
+	{"max block len string", `{{ "` + strings.Repeat("a", 1000) + `" }}`, func(l *lexer) { l.maxBlockLen = 10 }, []item{tLeft, tErr("block longer than 10 bytes")}},
+	{"max block len raw string", "{{ `" + strings.Repeat("a", 1000) + "` }}", func(l *lexer) { l.maxBlockLen = 10 }, []item{tLeft, tErr("block longer than 10 bytes")}},
+	{"max block len regex", "{{ /" + strings.Repeat("a", 1000) + "/ }}", func(l *lexer) { l.maxBlockLen = 10 }, []item{tLeft, tErr("block longer than 10 bytes")}},
+	{"max nest depth", "{{ ((((1)))) }}", func(l *lexer) { l.maxNestDepth = 3 },
+		[]item{tLeft, mkItem(itemLeftParen, "("), mkItem(itemLeftParen, "("), mkItem(itemLeftParen, "("), tErr("brackets nested deeper than 3")}},
+	{"max blocks", "{{1}}{{2}}", func(l *lexer) { l.maxBlocks = 1 }, []item{tLeft, tNum("1"), tRight, tErr("more than 1 blocks")}},
+	{"tabs forbidden", "{{\t1 }}", func(l *lexer) { l.noTabsInBlocks = true }, []item{tLeft, tErr("tab in block")}},
+	{"tabs forbidden later", "{{ \t1 }}", func(l *lexer) { l.noTabsInBlocks = true }, []item{tLeft, tErr("tab in block")}},
+	{"tabs", "{{\t1 }}", nil, block(tNum("1"))},
+
+	// text
+	{"trim markers off", "x {{- 1 }}", nil, []item{tText("x "), tLeft, tOp("-"), tNum("1"), tRight, tEOF}},
+	{"delim escape", `a\{{b\{{{{1}}`, nil, []item{tText("a{{b{{"), tLeft, tNum("1"), tRight, tEOF}},
+	{"delim escape off", `a\{{1}}`, func(l *lexer) { l.delimEscape = "" }, []item{tText(`a\`), tLeft, tNum("1"), tRight, tEOF}},
+	{"backslash before escape", `ab\\{{1}}`, nil, []item{tText(`ab\`), tLeft, tNum("1"), tRight, tEOF}},
+	{"escaped backslash path", `C:\\{{dir}}\\\{{x`, nil, []item{tText(`C:\`), tLeft, tIdent("dir"), tRight, tText(`\{{x`), tEOF}},
+	{"lone backslash", `\`, nil, []item{tText(`\`), tEOF}},
+	{"lone brace", "{", nil, []item{tText("{"), tEOF}},
+	{"braces in text", "ünï { and } text{{1}}x{", nil, []item{tText("ünï { and } text"), tLeft, tNum("1"), tRight, tText("x{"), tEOF}},
+	{"doubled delim", "a{{{{b", func(l *lexer) { l.doubledDelimEscape = true }, []item{tText("a{{b"), tEOF}},
+	{"doubled delim block", "a{{{{b{{1}}", func(l *lexer) { l.doubledDelimEscape = true }, []item{tText("a{{b"), tLeft, tNum("1"), tRight, tEOF}},
+	{"doubled delim escaped", `\{{{{{{1}}`, func(l *lexer) { l.doubledDelimEscape = true }, []item{tText("{{{{1}}"), tEOF}},
+	{"doubled delim only", "a{{{{b", func(l *lexer) { l.doubledDelimEscape, l.delimEscape = true, "" }, []item{tText("a{{b"), tEOF}},
+	{"newlines", "a\nb\\{{\n\n{{1}}\n", func(l *lexer) { l.emitNewlines = true }, []item{tText("a"), mkItem(itemNewline, "\n"), tText("b{{"),
+		mkItem(itemNewline, "\n"), mkItem(itemNewline, "\n"), tLeft, tNum("1"), tRight, mkItem(itemNewline, "\n"), tEOF}},
+	{"stop after first block", "{{1}} middle {{2}}\nend", func(l *lexer) { l.stopAfterFirstBlock = true },
+		[]item{tLeft, tNum("1"), tRight, tText(" middle {{2}}\nend"), tEOF}},
+
+	// identifiers
+	{"normalize identifiers", "{{ FooBar IF }}", func(l *lexer) {
+		l.normalizeIdentifiers = true
+		l.keywords = map[string]bool{"if": true}
+		l.foldKeywords = true
+	}, block(tIdent("foobar"), mkItem(itemKeyword, "if"))},
+	{"phrase", "{{ a not in b }}", phrases, block(tIdent("a"), mkItem(itemKeyword, "not in"), tIdent("b"))},
+	{"phrase split", "{{ a not  inb }}", phrases, block(tIdent("a"), tIdent("not"), tIdent("inb"))},
+	{"phrase cut", "{{ a not }}", phrases, block(tIdent("a"), tIdent("not"))},
+	{"phrase spaced", "{{ a is not  b }}", phrases, block(tIdent("a"), mkItem(itemKeyword, "is not"), tIdent("b"))},
+	{"phrase keyword", "{{ a is b }}", phrases, block(tIdent("a"), mkItem(itemKeyword, "is"), tIdent("b"))},
+	{"ident cont", "{{ foo-bar - x }}", func(l *lexer) {
+		l.identCont = func(r rune) bool { return r == '-' || r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r) }
+	}, block(tIdent("foo-bar"), tOp("-"), tIdent("x"))},
+	{"ident start", "{{ $x }}", func(l *lexer) {
+		l.identStart = func(r rune) bool { return r == '$' || unicode.IsLetter(r) }
+	}, block(tIdent("$x"))},
+
+	// regexes and paths
+	{"regex", "{{ /abc/i }}", nil, block(mkItem(itemRegex, "/abc/i"))},
+	{"regex escape", `{{ /a\/b/ }}`, nil, block(mkItem(itemRegex, `/a\/b/`))},
+	{"division", "{{ 1 / 2 }}", nil, block(tNum("1"), tOp("/"), tNum("2"))},
+	{"paren division", "{{ (a)/2 }}", nil, block(mkItem(itemLeftParen, "("), tIdent("a"), mkItem(itemRightParen, ")"), tOp("/"), tNum("2"))},
+	{"brace division", "{{ {a:1} / 2 }}", nil, block(mkItem(itemLeftBrace, "{"), tIdent("a"), mkItem(itemColon, ":"), tNum("1"), mkItem(itemRightBrace, "}"),
+		tOp("/"), tNum("2"))},
+	{"brace subtract", "{{ {a:1} -1 }}", nil, block(mkItem(itemLeftBrace, "{"), tIdent("a"), mkItem(itemColon, ":"), tNum("1"), mkItem(itemRightBrace, "}"),
+		tOp("-"), tNum("1"))},
+	{"unterminated regex", "{{ /abc }}", nil, []item{tLeft, tErr("unterminated regex")}},
+	{"path", "{{ /users/1 }}", func(l *lexer) { l.paths = true }, block(mkItem(itemPath, "/users/1"))},
+	{"path brace", "{{ /users/{id}}}", func(l *lexer) { l.paths = true }, []item{tLeft, mkItem(itemPath, "/users/{id"), tRight, tText("}"), tEOF}},
+	{"path division", "{{ x / 2 /a/b }}", func(l *lexer) { l.paths = true }, block(tIdent("x"), tOp("/"), tNum("2"), tOp("/"), tIdent("a"), tOp("/"), tIdent("b"))},
+
+	{"operators", "{{ 2 ** 3 // 4 / 5 }}", func(l *lexer) { l.operators = []string{"*", "**", "//"} },
+		block(tNum("2"), tOp("**"), tNum("3"), tOp("//"), tNum("4"), tOp("/"), tNum("5"))},
+	{"sub-lexer", "{{ @foo 1 }}", func(l *lexer) {
+		l.Register(func(r rune) bool { return r == '@' }, func(l *lexer) stateFn {
+			l.next()
+			for isIdentStart(l.peak()) {
+				l.next()
+			}
+			l.emit(itemComment)
+			return lexInsideBlock
+		})
+	}, block(mkItem(itemComment, "@foo"), tNum("1"))},
+	{"keep whitespace", "{{ 1 -5 x / 2 @tag  }}", func(l *lexer) {
+		l.keepWhitespace, l.trimTokenValues = true, true
+		l.Register(func(r rune) bool { return r == '@' }, func(l *lexer) stateFn {
+			for l.next() != ' ' {
+			}
+			l.emit(itemIdentifier) // "@tag " with its trailing space
+			return lexInsideBlock
+		})
+	}, block(mkItem(itemSpace, " "), tNum("1"), mkItem(itemSpace, " "), tOp("-"), tNum("5"), mkItem(itemSpace, " "), tIdent("x"),
+		mkItem(itemSpace, " "), tOp("/"), mkItem(itemSpace, " "), tNum("2"), mkItem(itemSpace, " "), tIdent("@tag"), mkItem(itemSpace, " "))},
+
+	// delimiters
+	{"env ref", "path=${HOME}/bin", envRefs, []item{tText("path="), mkItem(itemLeftMeta, "${"), mkItem(itemEnvRef, "HOME"), mkItem(itemRightMeta, "}"), tText("/bin"), tEOF}},
+	{"env ref number", "a${ 1 }", envRefs, []item{tText("a"), mkItem(itemLeftMeta, "${"), tErr(`malformed reference: " 1 }"`)}},
+	{"custom delims", "a<% 1 %>b", func(l *lexer) { l.leftDelim, l.rightDelim = "<%", "%>" },
+		[]item{tText("a"), mkItem(itemLeftMeta, "<%"), tNum("1"), mkItem(itemRightMeta, "%>"), tText("b"), tEOF}},
+	{"custom delims braces", "<% 1 {{ %>", func(l *lexer) { l.leftDelim, l.rightDelim = "<%", "%>" },
+		[]item{mkItem(itemLeftMeta, "<%"), tNum("1"), mkItem(itemLeftBrace, "{"), mkItem(itemLeftBrace, "{"), mkItem(itemRightMeta, "%>"), tEOF}},
+	{"delimiter pairs", "{{ 1 }}{% 2 %}x{%%}", stmtDelims, []item{tLeft, tNum("1"), tRight, mkItem(itemLeftStmt, "{%"), tNum("2"), mkItem(itemRightStmt, "%}"),
+		tText("x"), mkItem(itemLeftStmt, "{%"), mkItem(itemRightStmt, "%}"), tEOF}},
+	{"mismatched pair", "{% 1 }}", stmtDelims, []item{mkItem(itemLeftStmt, "{%"), tNum("1"), mkItem(itemRightBrace, "}"), mkItem(itemRightBrace, "}"), tErr("unclosed block")}},
+	{"delimiter pairs text", "a\\{{b{{1}}c{%2%}ü{{3}}", stmtDelims, []item{tText("a{{b"), tLeft, tNum("1"), tRight, tText("c"),
+		mkItem(itemLeftStmt, "{%"), tNum("2"), mkItem(itemRightStmt, "%}"), tText("ü"), tLeft, tNum("3"), tRight, tEOF}},
+	{"unclosed pair", "x{%", stmtDelims, []item{tText("x"), mkItem(itemLeftStmt, "{%"), tErr("unclosed block")}},
+	{"sections open", "{{#each}}", func(l *lexer) { l.sections = true }, block(mkItem(itemOpenSection, "#"), tIdent("each"))},
+	{"sections close", "{{/each}}", func(l *lexer) { l.sections = true }, block(mkItem(itemCloseSection, "/"), tIdent("each"))},
+	{"sections markers", "{{#each}}", func(l *lexer) { l.sections, l.blockMarkers = true, true },
+		block(mkItem(itemBlockStart, ""), mkItem(itemOpenSection, "#"), tIdent("each"), mkItem(itemBlockEnd, ""))},
+	{"heredoc", "a{{<<END}}\none {{x}}\ntwo\nEND\nb{{1}}", nil, []item{tText("a"), tLeft, mkItem(itemHeredocTag, "END"), tRight,
+		mkItem(itemHeredoc, "one {{x}}\ntwo"), tText("b"), tLeft, tNum("1"), tRight, tEOF}},
+	{"empty heredoc", "{{<<E}}\nE", nil, []item{tLeft, mkItem(itemHeredocTag, "E"), tRight, mkItem(itemHeredoc, ""), tEOF}},
+	{"unterminated heredoc", "{{<<END}}\nx\nEN", nil, []item{tLeft, mkItem(itemHeredocTag, "END"), tRight, tErr("unterminated heredoc END")}},
+	{"comment", "a{{/* c */}}b", nil, []item{tText("a"), tLeft, mkItem(itemComment, "/* c */"), tRight, tText("b"), tEOF}},
+	{"comment then content", "{{/* c */ 1}}", nil, []item{tLeft, mkItem(itemComment, "/* c */"), tErr("comment ends before closing delimiter")}},
+}
+
+func phrases(l *lexer) {
+	l.phrases = []string{"not in", "is not"}
+	l.keywords = map[string]bool{"is": true}
+}
+
+func envRefs(l *lexer) {
+	l.leftDelim, l.rightDelim = "${", "}"
+	l.envRefs = true
+}
+
+func stmtDelims(l *lexer) {
+	l.AddDelimiters("{%", "%}", itemLeftStmt, itemRightStmt)
+}
+
+// collect gathers items up to and including EOF or the first error
+func collect(l *lexer) []item {
+	var items []item
+	for {
+		i := l.nextItem()
+		items = append(items, i)
+		if i.typ == itemEOF || i.typ == itemError {
+			return items
+		}
+	}
+}
+
+// lexer runs test's options on a scanner built by mk
+func (test lexTest) lexer(mk func(name, input string) *lexer) *lexer {
+	l := mk(test.name, test.input)
+	if test.opts != nil {
+		test.opts(l)
+	}
+	return l
+}
+
+func TestLex(t *testing.T) {
+	for _, test := range lexTests {
+		if err := CompareItems(collect(test.lexer(NewScanner)), test.items); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+// the delivery modes hand over the same stream
+func TestLexModes(t *testing.T) {
+	for _, test := range lexTests {
+		want := collect(test.lexer(NewScanner))
+		for mode, mk := range map[string]func(string, string) *lexer{"sync": NewSyncScanner, "concurrent": NewConcurrentScanner} {
+			if err := CompareItems(collect(test.lexer(mk)), want); err != nil {
+				t.Errorf("%s, %s: %v", test.name, mode, err)
+			}
+		}
+	}
+}
+
+// a state returning to lexInsideBlock with input read but not emitted is a
+// bug, reported rather than lexed as part of the delimiter or as text
+func TestPendingAtClose(t *testing.T) {
+	l := NewSyncScanner("t", "{{x}}")
+	l.nextItem()
+	l.next()
+	l.state = lexInsideBlock
+	want := []item{tErr(`internal error: "x" left pending at right delimiter`)}
+	if err := CompareItems(collect(l), want); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// item order doesn't depend on how many items the channel buffers, nor on
+// whether the states run on their own goroutine
+func TestBufferSizes(t *testing.T) {
+	for _, test := range lexTests {
+		want := collect(test.lexer(NewSyncScanner))
+		for _, size := range []int{0, 1, 2, 64} {
+			buffered := func(name, input string) *lexer { return NewScannerBuffer(name, input, size) }
+			concurrent := test.lexer(buffered)
+			concurrent.done = make(chan struct{})
+			for mode, l := range map[string]*lexer{"inline": test.lexer(buffered), "concurrent": concurrent} {
+				if err := CompareItems(collect(l), want); err != nil {
+					t.Errorf("%s, %s, buffer %d: %v", test.name, mode, size, err)
+				}
+			}
+		}
+	}
+}
+
+func TestConstants(t *testing.T) {
+	if DefaultLeftDelim != "{{" || DefaultRightDelim != "}}" || DefaultBufferSize != 2 {
+		t.Fatal(DefaultLeftDelim, DefaultRightDelim, DefaultBufferSize)
+	}
+	l := NewScanner("t", "")
+	if l.leftDelim != DefaultLeftDelim || l.rightDelim != DefaultRightDelim || cap(l.items) != DefaultBufferSize {
+		t.Fatal(l.leftDelim, l.rightDelim, cap(l.items))
+	}
+}
+
+func TestWriteTokens(t *testing.T) {
+	var b bytes.Buffer
+	if err := NewScanner("t", "a{{ 1 }}").WriteTokens(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "TEXT\t\"a\"\nLEFTMETA\t\"{{\"\nNUMBER\t\"1\"\nRIGHTMETA\t\"}}\"\nEOF\t\"\"\n"
+	if b.String() != want {
+		t.Fatalf("got %q, want %q", b.String(), want)
+	}
+	if err := NewScanner("t", "{{ # }}").WriteTokens(&b); err == nil || err.Error() != "unexpected char in block: U+0023 '#'" {
+		t.Fatal(err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	var b bytes.Buffer
+	if err := NewScanner("t", "{{1}}").Dump(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := "#  TYPE       POS  VALUE\n0  LEFTMETA   1:1  \"{{\"\n1  NUMBER     1:3  \"1\"\n2  RIGHTMETA  1:4  \"}}\"\n3  EOF        1:6  \"\"\n"
+	if b.String() != want {
+		t.Fatalf("got %q, want %q", b.String(), want)
+	}
+}
+
+func TestMaxItems(t *testing.T) {
+	l := NewScanner("t", "{{ 1 2 3 4 5 6 7 8 }}")
+	l.maxItems = 3
+	items, err := l.Tokenize()
+	if err == nil || err.Error() != "too many items: limit is 3" {
+		t.Fatal(err)
+	}
+	if err := CompareItems(items, []item{tLeft, tNum("1"), tNum("2")}); err != nil {
+		t.Fatal(err)
+	}
+	if items, err := Lex("t", "{{ 1 2 3 4 5 6 7 8 }}"); err != nil || len(items) != 11 {
+		t.Fatal(len(items), err)
+	}
+	items, err = LexN("t", "{{ 1 2 3 4 5 6 7 8 }}", 3)
+	if err == nil || err.Error() != "too many items: limit is 3" || len(items) != 3 {
+		t.Fatal(len(items), err)
+	}
+	if items, err := LexN("t", "{{ 1 2 3 4 5 6 7 8 }}", 11); err != nil || len(items) != 11 {
+		t.Fatal(len(items), err)
+	}
+}
+
+func TestLexDocuments(t *testing.T) {
+	items, err := LexDocuments("t", "a{{1}}\n---\n{{2}}", "\n---\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []item{tText("a"), tLeft, tNum("1"), tRight, tLeft, tNum("2"), tRight, tEOF}
+	if err := CompareItems(items, want); err != nil {
+		t.Fatal(err)
+	}
+	var docs []int
+	for _, i := range items {
+		docs = append(docs, i.doc)
+	}
+	if fmt.Sprint(docs) != "[0 0 0 0 1 1 1 1]" {
+		t.Fatal(docs)
+	}
+}
+
+func TestPositions(t *testing.T) {
+	l := NewScanner("t", "café {{ 12 }}")
+	l.runePositions = true
+	items := collect(l)
+	if items[1].pos != 5 || items[2].pos != 8 || items[3].pos != 11 {
+		t.Fatal(items[1].pos, items[2].pos, items[3].pos)
+	}
+	if items = collect(NewScanner("t", "café {{ 12 }}")); items[2].pos != 9 {
+		t.Fatal(items[2].pos)
+	}
+	if items = collect(NewScanner("t", `ab{{ "x\"y\n" }}`)); items[2].val != "x\"y\n" || items[2].pos != 5 || items[3].pos != 14 {
+		t.Fatal(items[2].pos, items[3].pos)
+	}
+	if items = collect(NewScanner("t", "{{1}}{{2}}")); items[len(items)-1].pos != 10 {
+		t.Fatal(items[len(items)-1].pos)
+	}
+}
+
+func TestColumns(t *testing.T) {
+	for _, test := range []struct {
+		input     string
+		tabWidth  int
+		line, col int
+	}{
+		{"\t{{", 4, 1, 5},
+		{"ab\t{{", 4, 1, 5},
+		{"\t{{", 0, 1, 2},
+		{"a\nbé{{", 0, 2, 3},
+	} {
+		l := NewScanner("t", test.input)
+		l.tabWidth = test.tabWidth
+		if i := collect(l)[1]; i.line != test.line || i.col != test.col {
+			t.Errorf("%q: got %d:%d, want %d:%d", test.input, i.line, i.col, test.line, test.col)
+		}
+	}
+	l := NewScanner("t", "a\nbé{{\n 12\n}}")
+	l.allowMultilineBlocks = true
+	items := collect(l)
+	if n, r := items[2], items[3]; n.line != 3 || n.col != 2 || r.line != 4 || r.col != 1 {
+		t.Fatal(n.line, n.col, r.line, r.col)
+	}
+}
+
+func TestClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	l := NewConcurrentScanner("t", "{{ "+strings.Repeat("1 ", 100)+"}}")
+	if i := l.nextItem(); i.typ != itemLeftMeta {
+		t.Fatal(i)
+	}
+	l.Close()
+	if i := l.nextItem(); i.typ != itemEOF {
+		t.Fatal(i)
+	}
+	l.Close() // twice is fine
+	for n := 0; n < 100 && runtime.NumGoroutine() > before; n++ {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Fatalf("%d goroutines before, %d after", before, after)
+	}
+	for _, l := range []*lexer{NewScanner("t", "a{{ 1 }}"), NewConcurrentScanner("t", "x")} {
+		l.Close()
+		if i := l.nextItem(); i.typ != itemEOF {
+			t.Fatal(i)
+		}
+	}
+}
+
+func TestNoGoroutine(t *testing.T) {
+	before := runtime.NumGoroutine()
+	l := NewSyncScanner("t", "a{{ 1 - - - - - }}")
+	l.blockMarkers = true
+	var items []item
+	for i := l.NextItem(); ; i = l.NextItem() {
+		items = append(items, i)
+		if i.typ == itemEOF {
+			break
+		}
+	}
+	if n := runtime.NumGoroutine(); n != before {
+		t.Fatalf("%d goroutines before, %d after", before, n)
+	}
+	want := []item{tText("a"), tLeft, mkItem(itemBlockStart, ""), tNum("1"), tOp("-"), tOp("-"), tOp("-"), tOp("-"), tOp("-"),
+		mkItem(itemBlockEnd, ""), tRight, tEOF}
+	if err := CompareItems(items, want); err != nil {
+		t.Fatal(err)
+	}
+	if l.NextItem().typ != itemEOF {
+		t.Fatal("past EOF")
+	}
+}
+
+func TestOverflowFlag(t *testing.T) {
+	l := NewScanner("t", "{{ 123456789012345678901234567890 1 0xFFFFFFFFFFFFFFFFFF }}")
+	l.checkOverflow = true
+	items := collect(l)
+	if !items[1].overflow || items[2].overflow || !items[3].overflow {
+		t.Fatal(items[1].overflow, items[2].overflow, items[3].overflow)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	l := NewScanner("t", "ab{{1}}")
+	if l.Progress() != 0 || l.RemainingBytes() != 7 {
+		t.Fatal(l.Progress(), l.RemainingBytes())
+	}
+	l.nextItem()
+	l.nextItem()
+	if l.RemainingBytes() != 3 {
+		t.Fatal(l.RemainingBytes())
+	}
+	collect(l)
+	if l.Progress() != 1 || NewScanner("", "").Progress() != 1 {
+		t.Fatal(l.Progress())
+	}
+	// polled while the goroutine lexes ahead (run with -race)
+	l = NewConcurrentScanner("t", strings.Repeat("a{{ 1 }}", 1000))
+	for last := 0.0; ; {
+		i := l.nextItem()
+		p := l.Progress()
+		if p < last {
+			t.Fatal(p, last)
+		}
+		last = p
+		if i.typ == itemEOF {
+			break
+		}
+	}
+	if l.RemainingBytes() != 0 {
+		t.Fatal(l.RemainingBytes())
+	}
+}
+
+func TestPredicates(t *testing.T) {
+	for typ := range itemNames {
+		d, l, o := typ.IsDelimiter(), typ.IsLiteral(), typ.IsOperator()
+		wd := typ == itemLeftMeta || typ == itemRightMeta || typ == itemLeftStmt || typ == itemRightStmt
+		wl := typ == itemNumber || typ == itemString || typ == itemDateTime || typ == itemRawString || typ == itemRegex ||
+			typ == itemFloat || typ == itemHeredoc || typ == itemPath
+		wo := typ == itemOperator
+		if d != wd || l != wl || o != wo {
+			t.Errorf("%s: delimiter %v, literal %v, operator %v", typ, d, l, o)
+		}
+	}
+}
+
+func TestRecorded(t *testing.T) {
+	l := NewScanner("t", "a{{ 1 }}")
+	l.recordItems = true
+	items := collect(l)
+	l.nextItem()
+	if !reflect.DeepEqual(items, l.Recorded()) {
+		t.Fatal(items, l.Recorded())
+	}
+}
+
+// utf16Bytes encodes s as UTF-16, little-endian when le, BOM first when bom
+func utf16Bytes(s string, le, bom bool) []byte {
+	u := utf16.Encode([]rune(s))
+	if bom {
+		u = append([]uint16{0xFEFF}, u...)
+	}
+	var b []byte
+	for _, x := range u {
+		if le {
+			b = append(b, byte(x), byte(x>>8))
+		} else {
+			b = append(b, byte(x>>8), byte(x))
+		}
+	}
+	return b
+}
+
+func TestEncoding(t *testing.T) {
+	in := "é{{ 1 }}"
+	want := collect(NewScanner("t", in))
+	for _, test := range []struct {
+		data []byte
+		enc  Encoding
+	}{
+		{utf16Bytes(in, true, false), EncodingUTF16LE},
+		{utf16Bytes(in, true, true), EncodingUTF16},
+		{utf16Bytes(in, false, true), EncodingUTF16},
+		{utf16Bytes(in, false, false), EncodingUTF16BE},
+		{[]byte("\uFEFF" + in), EncodingUTF8},
+	} {
+		if got := collect(NewScannerEncoding("t", test.data, test.enc)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: %v", test.enc, got)
+		}
+	}
+}
+
+func TestIsRuneBoundary(t *testing.T) {
+	l := NewScanner("t", "aé😀")
+	for n, want := range []bool{true, true, false, true, false, false, false, true} {
+		if l.IsRuneBoundary(n) != want {
+			t.Errorf("%d: got %v", n, !want)
+		}
+	}
+	if l.IsRuneBoundary(-1) || l.IsRuneBoundary(8) {
+		t.Error("out of range")
+	}
+}
+
+func TestEOFAfterError(t *testing.T) {
+	for _, mk := range []func(string, string) *lexer{NewScanner, NewSyncScanner, NewConcurrentScanner} {
+		l := mk("t", "{{ 1 }}")
+		collect(l)
+		if l.nextItem().afterError {
+			t.Error("clean input")
+		}
+		l = mk("t", "{{ # }}")
+		collect(l)
+		for n := 0; n < 2; n++ {
+			if i := l.nextItem(); i.typ != itemEOF || !i.afterError {
+				t.Error("errored input", i)
+			}
+		}
+	}
+}
+
+func TestNormalizeNumbersRaw(t *testing.T) {
+	l := NewScanner("t", "{{ +007 5 }}")
+	l.normalizeNumbers = true
+	items := collect(l)
+	if items[1].val != "7" || items[1].Raw() != "+007" || items[2].raw != "" || items[2].Raw() != "5" {
+		t.Fatal(items[1], items[2])
+	}
+	if items = collect(NewScanner("t", "{{ `a\\b` }}")); items[1].Raw() != "`a\\b`" {
+		t.Fatal(items[1].Raw())
+	}
+	if items = collect(NewScanner("t", `a\{{b`)); items[0].Raw() != `a\{{b` {
+		t.Fatal(items[0].Raw())
+	}
+}
+
+func TestScan(t *testing.T) {
+	var items []item
+	err := NewConcurrentScanner("t", "a{{ 1 2 }}").Scan(func(i item) bool {
+		items = append(items, i)
+		return i.typ != itemNumber
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CompareItems(items, []item{tText("a"), tLeft, tNum("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewScanner("t", "{{ # }}").Scan(func(item) bool { return true }); err == nil {
+		t.Fatal("no error")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a, b := collect(NewScanner("t", "{{1}}")), collect(NewScanner("t", "{{ 1}}"))
+	if !a[1].Equal(b[1]) || a[1].EqualExact(b[1]) || !a[1].EqualExact(a[1]) {
+		t.Fatal(a[1], b[1])
+	}
+}
+
+func TestSegments(t *testing.T) {
+	segs, err := Segments("t", "a{{1}}b{{2 3}}c")
+	if err != nil || len(segs) != 5 {
+		t.Fatal(segs, err)
+	}
+	for n, want := range []string{"a", "", "b", "", "c"} {
+		if s := segs[n]; s.Text != want || s.Block != (want == "") {
+			t.Errorf("%d: %+v", n, s)
+		}
+	}
+	if err := CompareItems(segs[3].Items, []item{tNum("2"), tNum("3")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrimMarkers(t *testing.T) {
+	l := NewScanner("t", "x {{- 1 -}} y {{-1}} z")
+	l.trimMarkers = true
+	items := collect(l)
+	want := []item{tText("x "), mkItem(itemLeftMeta, "{{-"), tNum("1"), mkItem(itemRightMeta, "-}}"), tText(" y "), tLeft, tNum("-1"), tRight, tText(" z"), tEOF}
+	if err := CompareItems(items, want); err != nil {
+		t.Fatal(err)
+	}
+	if x, y, z := items[0], items[4], items[8]; x.trimLeft || !x.trimRight || !y.trimLeft || y.trimRight || z.trimLeft {
+		t.Fatal(x, y, z)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	l := NewScanner("t", "{{ 1 # 2 ~ }}")
+	l.recoverErrors = true
+	l.nextItem()
+	errs := l.Errors()
+	if len(errs) != 2 || errs[0].val != "#" || errs[1].val != "~" || errs[1].pos != 9 {
+		t.Fatal(errs)
+	}
+	if errs := NewScanner("t", "{{ 1 # 2 ~ }}").Errors(); len(errs) != 1 || errs[0].typ != itemError {
+		t.Fatal(errs)
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	errs := ValidateAll("t", "{{ 1 & 2 ! }}\n{{ ~ ")
+	want := `[t:1:6: unexpected char in block: "&" t:1:10: unexpected char in block: "!" t:2:4: unexpected char in block: "~" t:2:6: unclosed block]`
+	if got := fmt.Sprint(errs); got != want {
+		t.Fatal(got)
+	}
+	if Validate("t", "{{ 1 }}") != nil || Validate("t", "{{ & }}") == nil || ValidateAll("t", "{{1}}") != nil {
+		t.Fatal("valid input")
+	}
+}
+
+func TestTrivia(t *testing.T) {
+	l := NewScanner("t", "{{  1 // c\n 2 }}")
+	l.attachTrivia = true
+	l.allowMultilineBlocks = true
+	l.lineCommentMarker = "//"
+	items := collect(l)
+	if err := CompareItems(items, block(tNum("1"), tNum("2"))); err != nil {
+		t.Fatal(err)
+	}
+	for n, want := range [][]string{nil, {"  "}, {" ", "// c", "\n", " "}, {" "}} {
+		if got := items[n].leadingTrivia; !reflect.DeepEqual(got, want) {
+			t.Errorf("%d: got %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	l := NewScanner("t", "a\n{{ }}{{1}}{{ # }}")
+	items := collect(l)
+	d := l.Diagnostics()
+	if len(d) != 2 || d[0].String() != "2:4: warning: empty block" || d[1].Severity != SeverityError || len(items) != 8 {
+		t.Fatal(d, items)
+	}
+	l = NewScanner("t", "{{ 1 }}{% 2 %}x{%%}")
+	stmtDelims(l)
+	collect(l)
+	if d := l.Diagnostics(); len(d) != 1 {
+		t.Fatal(d)
+	}
+	for _, in := range []string{"{{<<E}}\nE", "a{{/* c */}}b"} {
+		l = NewScanner("t", in)
+		collect(l)
+		if d := l.Diagnostics(); len(d) != 0 {
+			t.Fatal(in, d)
+		}
+	}
+}
+
+func TestNestDepth(t *testing.T) {
+	l := NewScanner("t", "{{ ((1) }}")
+	l.maxNestDepth = 3
+	collect(l)
+	if l.NestDepth() != 1 {
+		t.Fatal(l.NestDepth())
+	}
+}
+
+func TestReconstruct(t *testing.T) {
+	for _, in := range []string{"a{{1}}b", "x{{ \"a\\tb\" }}y", "{{  1 ,2}}", "a{{<<END}}\none {{x}}\nEND\nb"} {
+		l := NewScanner("t", in)
+		l.attachTrivia = true
+		items, err := l.Tokenize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := Reconstruct(items); err != nil || got != in {
+			t.Errorf("got %q, %v, want %q", got, err, in)
+		}
+	}
+}
+
+func TestOnTransition(t *testing.T) {
+	l := NewSyncScanner("t", "{{1}}")
+	var pairs []string
+	l.OnTransition(func(from, to string) { pairs = append(pairs, from+">"+to) })
+	collect(l)
+	want := "lexText>lexLeftMeta lexLeftMeta>lexInsideBlock lexInsideBlock>lexNumber lexNumber>lexInsideBlock " +
+		"lexInsideBlock>lexRightMeta lexRightMeta>lexText lexText>"
+	if got := strings.Join(pairs, " "); got != want {
+		t.Fatal(got)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	items, err := Lex("t", "a{{1}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := json.Marshal(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var back []struct {
+		Type, Val      string
+		Pos, Line, Col int
+	}
+	if err := json.Unmarshal(out, &back); err != nil {
+		t.Fatal(err)
+	}
+	if len(back) != 5 || back[2].Type != "NUMBER" || back[2].Val != "1" || back[2].Pos != 3 || back[2].Col != 4 || back[4].Type != "EOF" {
+		t.Fatalf("%s", out)
+	}
+}
+
+func TestAtEOF(t *testing.T) {
+	l := NewScanner("t", "ab")
+	l.next()
+	if l.AtEOF() {
+		t.Fatal("early")
+	}
+	l.next()
+	for n := 0; n < 3; n++ {
+		if !l.AtEOF() || l.next() != eof || l.width != 0 || l.pos != 2 {
+			t.Fatal(n, l.width, l.pos)
+		}
+		l.backup()
+	}
+}
+
+func TestStopAfterFirstBlockPos(t *testing.T) {
+	l := NewScanner("t", "{{1}} middle {{2}}\nend")
+	l.stopAfterFirstBlock = true
+	items := collect(l)
+	if e := items[len(items)-1]; e.line != 2 || e.col != 4 {
+		t.Fatal(e.line, e.col)
+	}
+}
+
+func TestSpan(t *testing.T) {
+	l := NewScanner("t", "a{{ `x\nyz` }}")
+	l.allowMultilineBlocks = true
+	items := collect(l)
+	if s := items[2].Span(); s != (Span{4, 10, 1, 2, 5, 4}) {
+		t.Fatalf("%+v", s)
+	}
+	if s := items[0].Span(); s != (Span{0, 1, 1, 1, 1, 2}) {
+		t.Fatalf("%+v", s)
+	}
+}
+
+func TestScannerInterface(t *testing.T) {
+	var s Scanner = NewScanner("t", "a{{1}}")
+	if p := s.Peek(); p.typ != itemText || s.Peek().val != "a" {
+		t.Fatal(p)
+	}
+	if n := s.Next(); n.val != "a" {
+		t.Fatal(n)
+	}
+	if n := s.Next(); n.typ != itemLeftMeta {
+		t.Fatal(n)
+	}
+	s.Peek()
+	items, err := s.(*lexer).Tokenize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CompareItems(items, []item{tNum("1"), tRight, tEOF}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if s.Next().typ != itemEOF {
+		t.Fatal("after close")
+	}
+}
+
+func TestLens(t *testing.T) {
+	items, _ := Lex("t", "héllo{{1}}")
+	if items[0].ByteLen() != 6 || items[0].RuneLen() != 5 {
+		t.Fatal(items[0].ByteLen(), items[0].RuneLen())
+	}
+}
+
+func TestScannerBytes(t *testing.T) {
+	in := []byte("a{{ 1 \"x\" }}b")
+	if items, want := collect(NewScannerBytes("t", in)), collect(NewScanner("t", string(in))); !reflect.DeepEqual(items, want) {
+		t.Fatal(items, want)
+	}
+	// what onEOF adds is past the end of the bytes
+	l := NewScannerBytes("t", []byte("a"))
+	tail := "é{{1}}"
+	l.onEOF = func() (s string) {
+		s, tail = tail, ""
+		return s
+	}
+	if err := CompareItems(collect(l), []item{tText("aé"), tLeft, tNum("1"), tRight, tEOF}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNextUntil(t *testing.T) {
+	l := NewScanner("t", "{{ 1 2 }} tail")
+	l.Next()
+	if err := CompareItems(l.NextUntil(itemRightMeta), []item{tNum("1"), tNum("2")}); err != nil {
+		t.Fatal(err)
+	}
+	if l.Next().typ != itemRightMeta {
+		t.Fatal("stop consumed")
+	}
+	if err := CompareItems(l.NextUntil(itemLeftMeta), []item{tText(" tail")}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNumberScanner(t *testing.T) {
+	items := collect(NewNumberScanner("t", "a{{ 1 -2  30 }}b"))
+	if err := CompareItems(items, []item{tText("a"), tLeft, tNum("1"), tNum("-2"), tNum("30"), tRight, tText("b"), tEOF}); err != nil {
+		t.Fatal(err)
+	}
+	if items = collect(NewNumberScanner("t", "{{ 1 x }}")); items[len(items)-1].typ != itemError {
+		t.Fatal(items)
+	}
+}
+
+func TestBlockDepth(t *testing.T) {
+	l := NewScanner("t", "a{{ 1 }}b")
+	l.blockMarkers = true
+	var depths []int
+	for _, i := range collect(l) {
+		depths = append(depths, i.blockDepth)
+	}
+	if fmt.Sprint(depths) != "[0 0 1 1 1 0 0 0]" {
+		t.Fatal(depths)
+	}
+}
+
+func TestInject(t *testing.T) {
+	l := NewScanner("t", "{{1}}")
+	if i := l.Next(); i.typ != itemLeftMeta {
+		t.Fatal(i)
+	}
+	l.Inject(tIdent("a"))
+	l.Inject(tOp("+"))
+	items := collect(l)
+	if err := CompareItems(items, []item{tIdent("a"), tOp("+"), tNum("1"), tRight, tEOF}); err != nil {
+		t.Fatal(err)
+	}
+	if !items[0].synthetic || !items[1].synthetic || items[2].synthetic {
+		t.Fatal("synthetic flags")
+	}
+}
+
+func TestCount(t *testing.T) {
+	for _, l := range []*lexer{NewSyncScanner("t", "{{1 2}}{{3}}"), NewConcurrentScanner("t", "{{1 2}}{{3}}")} {
+		seen := 0
+		for i := l.Next(); i.typ != itemEOF; i = l.Next() {
+			if i.typ == itemNumber {
+				seen++
+				if c := l.Count(itemNumber); c < seen {
+					t.Fatalf("counted %d after reading %d", c, seen)
+				}
+			}
+		}
+		if l.Count(itemNumber) != 3 || l.Count(itemLeftMeta) != 2 || l.Count(itemEOF) != 1 {
+			t.Fatal(l.Count(itemNumber), l.Count(itemLeftMeta), l.Count(itemEOF))
+		}
+	}
+}
+
+func TestReadInput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "t.tmpl")
+	if err := os.WriteFile(path, []byte("a{{1}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	name, in, err := readInput(path, true)
+	if err != nil || name != path || in != "a{{1}}" {
+		t.Fatal(name, in, err)
+	}
+	if _, in, _ := readInput(path, false); in != path {
+		t.Fatal(in)
+	}
+	if _, _, err := readInput(path+"x", true); err == nil {
+		t.Fatal("missing file")
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	items := collect(NewScanner("t", "{{ 1 + 2 * 3 == 7 }}"))
+	plus, times, eq := items[2], items[4], items[6]
+	if plus.val != "+" || times.val != "*" || eq.val != "==" {
+		t.Fatal(plus, times, eq)
+	}
+	if times.precedence <= plus.precedence || plus.precedence <= eq.precedence || eq.precedence == 0 {
+		t.Fatal(plus.precedence, times.precedence, eq.precedence)
+	}
+	l := NewScanner("t", "{{ a <= b && c }}")
+	l.operators = []string{"<=", "&&"}
+	if items := collect(l); items[2].precedence != DefaultPrecedence["<="] || items[4].precedence != DefaultPrecedence["&&"] {
+		t.Fatal(items[2], items[4])
+	}
+	l = NewScanner("t", "{{ 1 + 2 }}")
+	l.precTable = map[string]int{"+": 9}
+	if items := collect(l); items[2].precedence != 9 {
+		t.Fatal(items[2].precedence)
+	}
+}
+
+func TestStrictNumberBoundaryPos(t *testing.T) {
+	l := NewScanner("t", "{{ 12abc }}")
+	l.strictNumberBoundary = true
+	items := collect(l)
+	if e := items[len(items)-1]; e.pos != 5 {
+		t.Fatal(e.pos)
+	}
+}
+
+func TestStripComments(t *testing.T) {
+	clean, pos := StripComments("a{{/* c */}}b{{1}}c{{/* d */ }}")
+	if clean != "ab{{1}}c" {
+		t.Fatalf("%q", clean)
+	}
+	if pos(0) != 0 || pos(1) != 12 || pos(2) != 13 {
+		t.Fatal(pos(0), pos(1), pos(2))
+	}
+}
+
+func TestNewlinePositions(t *testing.T) {
+	l := NewScanner("t", "a\nb\\{{\n\n{{1}}\n")
+	l.emitNewlines = true
+	items := collect(l)
+	if b := items[2]; b.pos != 2 || b.line != 2 || b.col != 1 {
+		t.Fatal(b.pos, b.line, b.col)
+	}
+	if n := items[4]; n.pos != 7 || n.line != 3 || n.col != 1 {
+		t.Fatal(n.pos, n.line, n.col)
+	}
+}
+
+func TestOnEOF(t *testing.T) {
+	l := NewScanner("t", "a{{1}}b")
+	calls := 0
+	l.onEOF = func() string {
+		calls++
+		if calls == 1 {
+			return "c{{2}}"
+		}
+		return ""
+	}
+	want := []item{tText("a"), tLeft, tNum("1"), tRight, tText("bc"), tLeft, tNum("2"), tRight, tEOF}
+	if err := CompareItems(collect(l), want); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatal(calls)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"a{{1 &}}"}, &stdout, &stderr); code != 1 || stderr.String() != "number lexer:1:6: unexpected char in block: U+0026 '&'\n" {
+		t.Fatal(code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), `"1"`) {
+		t.Fatal(stdout.String())
+	}
+	stdout.Reset()
+	stderr.Reset()
+	if code := run([]string{"-format=json", "a"}, &stdout, &stderr); code != 0 || !strings.HasPrefix(stdout.String(), `[{"type":"TEXT"`) {
+		t.Fatal(code, stdout.String(), stderr.String())
+	}
+	if code := run([]string{"-format=x", "a"}, &stdout, &stderr); code != 2 {
+		t.Fatal(code)
+	}
+}
+
+func TestSourceRange(t *testing.T) {
+	in := "é{{ 12 \"a\\tb\" }}ü"
+	l := NewScanner("t", in)
+	l.runePositions = true
+	for _, i := range collect(l) {
+		if s, e := i.SourceRange(); in[s:e] != i.Raw() {
+			t.Errorf("%s %q: input[%d:%d] is %q", i.typ, i.val, s, e, in[s:e])
+		}
+	}
+}
+
+func TestCompareItems(t *testing.T) {
+	items, _ := Lex("t", "a{{1}}")
+	want := []item{tText("a"), tLeft, tNum("2")}
+	if err := CompareItems(items, want); err == nil || err.Error() != `item 2: got NUMBER "1", want NUMBER "2"` {
+		t.Fatal(err)
+	}
+	if err := CompareItems(items[:2], want[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := CompareItems(items, want[:2]); err == nil || err.Error() != `item 2: got NUMBER "1", want no more items` {
+		t.Fatal(err)
+	}
+	if err := CompareItems(items[:1], want); err == nil || err.Error() != `item 1: got no more items, want LEFTMETA "{{"` {
+		t.Fatal(err)
+	}
+}
+
+func TestHighlightSpans(t *testing.T) {
+	for _, in := range []string{"a{{ 1 }}b", "x\n{{ \"s\"  2\t}}y", "a{{ 1 ", "{{ 1 }}", ""} {
+		pos := 0
+		for _, s := range HighlightSpans("t", in) {
+			if s.StartPos != pos || s.EndPos <= s.StartPos {
+				t.Fatalf("%q: span %+v after %d", in, s, pos)
+			}
+			pos = s.EndPos
+		}
+		if pos != len(in) {
+			t.Fatalf("%q: spans end at %d", in, pos)
+		}
+	}
+	spans := HighlightSpans("t", "a{{ 1 }}b")
+	want := []string{"text", "delimiter", "whitespace", "number", "whitespace", "delimiter", "text"}
+	if len(spans) != len(want) {
+		t.Fatalf("%+v", spans)
+	}
+	for n, s := range spans {
+		if s.Category != want[n] {
+			t.Errorf("%d: got %q, want %q", n, s.Category, want[n])
+		}
+	}
+	if gap, num := spans[2], spans[3]; gap.StartCol != 4 || num.StartCol != 5 || num.EndCol != 6 {
+		t.Fatalf("%+v %+v", gap, num)
+	}
+}
+
+var plainText = strings.Repeat("lorem ipsum dolor sit amet, ünïcode { and } text\n", 20000) + "{{1}}" + strings.Repeat("x", 1000)
+
+var longString = "{{ \"" + strings.Repeat("some long literal text ü ", 40000) + "\\n\\\"x\" `" + strings.Repeat("raw text ", 40000) + "` }}"
+
+func TestLongText(t *testing.T) {
+	items, err := Lex("t", plainText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []item{tText(plainText[:len(plainText)-1005]), tLeft, tNum("1"), tRight, tText(strings.Repeat("x", 1000)), tEOF}
+	if err := CompareItems(items, want); err != nil {
+		t.Fatal(err)
+	}
+	if l := items[1]; l.line != 20001 || l.col != 1 {
+		t.Fatal(l.line, l.col)
+	}
+	if items, err = Lex("t", longString); err != nil {
+		t.Fatal(err)
+	}
+	if s := items[1].val; !strings.HasSuffix(s, "ü \n\"x") || len(items[2].val) != len("raw text ")*40000 {
+		t.Fatal(len(s), len(items[2].val))
+	}
+}
+
+func TestOffsetValues(t *testing.T) {
+	for _, test := range lexTests {
+		l := test.lexer(NewScanner)
+		l.offsetValues = true
+		if err := CompareItems(collect(l), test.items); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+	l := NewScanner("t", `{{ "a\tb" x }}`)
+	l.offsetValues = true
+	items := collect(l)
+	if s, x := items[1], items[2]; s.val != "a\tb" || s.input != "" || x.val != "" || x.Value() != "x" || x.Raw() != "x" {
+		t.Fatal(s, x)
+	}
+
+	// the readers see the value however it's stored
+	in := "héllo{{ x }}"
+	offsets := func() *lexer {
+		l := NewScanner("t", in)
+		l.offsetValues = true
+		return l
+	}
+	plain := collect(NewScanner("t", in))
+	for n, i := range collect(offsets()) {
+		p := plain[n]
+		if i.String() != p.String() || i.Raw() != p.Raw() || i.ByteLen() != p.ByteLen() || i.RuneLen() != p.RuneLen() {
+			t.Errorf("%d: got %v, want %v", n, i, p)
+		}
+		a, _ := json.Marshal(i)
+		b, _ := json.Marshal(p)
+		if string(a) != string(b) {
+			t.Errorf("%d: got %s, want %s", n, a, b)
+		}
+	}
+	var got, want bytes.Buffer
+	offsets().WriteTokens(&got)
+	NewScanner("t", in).WriteTokens(&want)
+	offsets().Dump(&got)
+	NewScanner("t", in).Dump(&want)
+	if got.String() != want.String() {
+		t.Fatalf("got %q, want %q", got.String(), want.String())
+	}
+}
+
+func benchmarkLex(b *testing.B, in string, mk func(string, string) *lexer) {
+	b.ReportAllocs()
+	b.SetBytes(int64(len(in)))
+	for range b.N {
+		l := mk("b", in)
+		for l.nextItem().typ != itemEOF {
+		}
+	}
+}
+
+var tokens = strings.Repeat("text {{ 1 + 2 abc }} ", 10000)
+
+// offsets against values holding substrings of the input
+func BenchmarkOffsetValues(b *testing.B) {
+	for _, offsets := range []bool{false, true} {
+		b.Run(fmt.Sprintf("offsets=%v", offsets), func(b *testing.B) {
+			benchmarkLex(b, tokens, func(name, in string) *lexer {
+				l := NewScanner(name, in)
+				l.offsetValues = offsets
+				return l
+			})
+		})
+	}
+}
+
+// NewScannerBytes skips the copy of the whole input that string(in) makes
+func BenchmarkScannerBytes(b *testing.B) {
+	in := []byte(tokens)
+	b.Run("string", func(b *testing.B) {
+		benchmarkLex(b, tokens, func(name, _ string) *lexer { return NewScanner(name, string(in)) })
+	})
+	b.Run("bytes", func(b *testing.B) {
+		benchmarkLex(b, tokens, func(name, _ string) *lexer { return NewScannerBytes(name, in) })
+	})
+}
+
+var numbers = strings.Repeat("{{ 1 22 333 -4 }} ", 5000)
+
+func BenchmarkNumberScanner(b *testing.B) {
+	b.Run("general", func(b *testing.B) { benchmarkLex(b, numbers, NewScanner) })
+	b.Run("numbers", func(b *testing.B) { benchmarkLex(b, numbers, NewNumberScanner) })
+}
+
+// text with rare delimiters, where lexText jumps from one possible
+// delimiter to the next
+func BenchmarkPlainText(b *testing.B) {
+	benchmarkLex(b, plainText, NewScanner)
+}
+
+// a long string and raw string, scanned in runs up to the next rune that
+// needs a look
+func BenchmarkLongString(b *testing.B) {
+	benchmarkLex(b, longString, NewScanner)
+}
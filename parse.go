@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Node of the tree built by Parse
+type Node interface {
+	Position() int // start offset in input
+}
+
+// ListNode is the whole input, text and blocks in order
+type ListNode struct {
+	Pos   int
+	Nodes []Node
+}
+
+// TextNode is literal text between blocks
+type TextNode struct {
+	Pos  int
+	Text string
+}
+
+// BlockNode is a block holding numbers
+type BlockNode struct {
+	Pos     int
+	Numbers []*NumberNode
+}
+
+// NumberNode is a number inside a block
+type NumberNode struct {
+	Pos   int
+	Text  string // as written
+	Value int64
+}
+
+func (n *ListNode) Position() int   { return n.Pos }
+func (n *TextNode) Position() int   { return n.Pos }
+func (n *BlockNode) Position() int  { return n.Pos }
+func (n *NumberNode) Position() int { return n.Pos }
+
+// parser is recursive descent over the item stream, one item of lookahead
+type parser struct {
+	name string
+	lex  *lexer
+}
+
+// Parse builds the tree for input: text and blocks of numbers
+func Parse(name, input string) (*ListNode, error) {
+	p := &parser{name, NewScanner(name, input)}
+	defer p.lex.Close()
+	return p.list()
+}
+
+// list: (text | block)* EOF
+func (p *parser) list() (*ListNode, error) {
+	list := &ListNode{}
+	for {
+		switch i := p.lex.Peek(); i.typ {
+		case itemEOF:
+			return list, nil
+		case itemText:
+			p.lex.Next()
+			list.Nodes = append(list.Nodes, &TextNode{i.pos, i.val})
+		case itemLeftMeta:
+			b, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			list.Nodes = append(list.Nodes, b)
+		default:
+			return nil, p.unexpected(i)
+		}
+	}
+}
+
+// block: LEFTMETA NUMBER* RIGHTMETA
+func (p *parser) block() (*BlockNode, error) {
+	b := &BlockNode{Pos: p.lex.Next().pos}
+	for {
+		switch i := p.lex.Next(); i.typ {
+		case itemRightMeta:
+			return b, nil
+		case itemNumber:
+			n, err := p.number(i)
+			if err != nil {
+				return nil, err
+			}
+			b.Numbers = append(b.Numbers, n)
+		default:
+			return nil, p.unexpected(i)
+		}
+	}
+}
+
+func (p *parser) number(i item) (*NumberNode, error) {
+	base := 10
+	if s := strings.TrimLeft(i.val, "+-"); strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		base = 0
+	}
+	v, err := strconv.ParseInt(i.val, base, 64)
+	if err != nil {
+		return nil, p.errorf(i, "bad number %q", i.val)
+	}
+	return &NumberNode{i.pos, i.val, v}, nil
+}
+
+// unexpected reports i, passing lex errors through
+func (p *parser) unexpected(i item) error {
+	if i.typ == itemError {
+		return p.errorf(i, "%s", i.val)
+	}
+	return p.errorf(i, "unexpected %s %q", i.typ, i.val)
+}
+
+func (p *parser) errorf(i item, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d:%d: %s", p.name, i.line, i.col, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tree, err := Parse("t", "a{{1 0x10}}b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ListNode{Nodes: []Node{
+		&TextNode{0, "a"},
+		&BlockNode{1, []*NumberNode{{3, "1", 1}, {5, "0x10", 16}}},
+		&TextNode{11, "b"},
+	}}
+	if !reflect.DeepEqual(tree, want) {
+		t.Fatalf("got %#v", tree)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, test := range []struct {
+		input, err string
+	}{
+		{"a{{1 x}}", `t:1:6: unexpected IDENTIFIER "x"`},
+		{"a{{1", "t:1:5: unclosed block"},
+		{"{{99999999999999999999}}", `t:1:3: bad number "99999999999999999999"`},
+	} {
+		if _, err := Parse("t", test.input); err == nil || err.Error() != test.err {
+			t.Errorf("%q: got %v, want %s", test.input, err, test.err)
+		}
+	}
+}